@@ -0,0 +1,184 @@
+package api
+
+// REST management API so keys and servers can be driven by scripts without
+// anyone at the console. It calls the same servers functions as the CLI.
+//
+// All requests need an "Authorization: Bearer <token>" header, apart from the
+// web dashboard which is served from / and asks for the token itself.
+//
+//   GET    /api/keys                          list all keys
+//   POST   /api/keys                          create a key
+//   GET    /api/keys/<name>                   a single key
+//   PUT    /api/keys/<name>                   edit a key, keeping its hits
+//   DELETE /api/keys/<name>                   remove a key
+//   POST   /api/keys/<name>/<action>          on, off, disable, alert, noalert, clearhits
+//   GET    /api/servers/<http|dns>            server status and settings
+//   PUT    /api/servers/<http|dns>/settings/<setting>
+//   DELETE /api/servers/<http|dns>/settings/<setting>
+//   POST   /api/servers/<http|dns>/<action>   start, stop, restart
+//   GET    /api/events                        Server-Sent Events stream of every request and key change
+//   GET    /api/audit                         the audit log, ?key=<name> for a key and when it was turned on
+//   GET    /api/audit/verify                  check the audit log's hash chain, ?hash=<hash> from an earlier check
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoloobeek/keyserver/logger"
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+// maxBodySize limits request bodies, keys are small
+const maxBodySize = 1 << 20
+
+// Operator is who key changes made through the API are attributed to
+const Operator = "api"
+
+// Server is the management API for the HTTP and DNS servers
+type Server struct {
+	Http       *servers.HttpServer
+	Dns        *servers.DnsServer
+	Token      string
+	httpServer *http.Server
+	done       chan struct{} // closed on Stop to end event streams
+	stopOnce   sync.Once
+	dashboard  http.Handler
+}
+
+// apiError is the body of every error response
+type apiError struct {
+	Error string
+}
+
+// New returns a management API for the servers that accepts the bearer token
+func New(h *servers.HttpServer, d *servers.DnsServer, token string) *Server {
+	return &Server{
+		Http:      h,
+		Dns:       d,
+		Token:     token,
+		done:      make(chan struct{}),
+		dashboard: dashboardHandler(),
+	}
+}
+
+// GenerateToken returns a random token for when one isn't given
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Start listens on addr and serves the API in the background, over TLS if
+// certPath and keyPath are set. Listening errors are returned straight away.
+func (s *Server) Start(addr, certPath, keyPath string) error {
+	if s.Token == "" {
+		return errors.New("An API token is required")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.httpServer = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		var err error
+		if certPath != "" && keyPath != "" {
+			err = s.httpServer.ServeTLS(ln, certPath, keyPath)
+		} else {
+			err = s.httpServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Log.Warningf("[ERROR] - API server stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Stop gracefully shuts down the API, event streams never go idle so
+// they're ended first
+func (s *Server) Stop() error {
+	if s.httpServer == nil {
+		return nil
+	}
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.done)
+		err = s.httpServer.Shutdown(context.Background())
+	})
+	return err
+}
+
+// ServeHTTP checks the token and routes the request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		s.dashboard.ServeHTTP(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		logger.Log.Warningf("[API] - Unauthorized request from %s for %s", r.RemoteAddr, r.URL.Path)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "api" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch parts[1] {
+	case "keys":
+		s.handleKeys(w, r, parts[2:])
+	case "servers":
+		s.handleServers(w, r, parts[2:])
+	case "events":
+		s.handleEvents(w, r)
+	case "audit":
+		s.handleAudit(w, r, parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// authorized compares the bearer token in constant time
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &apiError{Error: msg})
+}
+
+// readJSON decodes the request body into v, rejecting unknown fields so
+// typos don't go unnoticed
+func readJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("Invalid request body: " + err.Error())
+	}
+	return nil
+}
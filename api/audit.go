@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+// auditLog is the body of GET /api/audit, Live is only set for a key
+type auditLog struct {
+	Entries []*servers.AuditEntry
+	Live    []*servers.LiveWindow `json:",omitempty"`
+}
+
+// auditCheck is the body of GET /api/audit/verify
+type auditCheck struct {
+	Verified bool
+	Entries  int
+	Head     string
+	Error    string `json:",omitempty"`
+}
+
+// handleAudit serves the audit log, ?key= limits it to one key (following
+// renames) and adds when it was manually turned on
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	switch {
+	case len(parts) == 0:
+	case len(parts) == 1 && parts[0] == "verify":
+		s.verifyAudit(w, r)
+		return
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	entries, err := servers.Audit.Entries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSON(w, http.StatusOK, &auditLog{Entries: entries})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &auditLog{
+		Entries: servers.KeyAuditEntries(entries, key),
+		Live:    servers.KeyLiveWindows(entries, key),
+	})
+}
+
+// verifyAudit checks the hash chain, ?hash= is a hash from an earlier check
+// that must still be in the log
+func (s *Server) verifyAudit(w http.ResponseWriter, r *http.Request) {
+	path := servers.Audit.Path()
+	if path == "" {
+		writeError(w, http.StatusInternalServerError, "The audit log isn't enabled")
+		return
+	}
+	n, head, err := servers.VerifyAuditLog(path, r.URL.Query().Get("hash"))
+	check := &auditCheck{Verified: err == nil, Entries: n, Head: head}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, check)
+}
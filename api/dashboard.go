@@ -0,0 +1,33 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard/*
+var dashboardFS embed.FS
+
+// dashboardHandler serves the embedded web dashboard. The files are static
+// and hold nothing sensitive, the page asks for the API token and sends it
+// with every API request itself.
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		// key names, paths and user agents end up on the page
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,347 @@
+// keyserver dashboard, talks to the management API with the token entered
+// at login. Everything from the API is added with textContent as key names,
+// paths and user agents come from whoever is hitting the servers.
+(function () {
+  'use strict';
+
+  var REFRESH_MS = 5000;
+  var MAX_ACTIVITY = 100;
+  var CHART_DAYS = 14;
+
+  var token = sessionStorage.getItem('keyserverToken') || '';
+  var refreshTimer = null;
+  var pendingRefresh = null;
+  var streamAbort = null;
+
+  //
+  // API
+  //
+
+  function api(method, path) {
+    return fetch(path, {
+      method: method,
+      headers: { 'Authorization': 'Bearer ' + token }
+    }).then(function (res) {
+      if (res.status === 401) {
+        logout('Invalid API token');
+        throw new Error('Unauthorized');
+      }
+      if (res.status === 204) {
+        return null;
+      }
+      return res.json().then(function (body) {
+        if (!res.ok) {
+          throw new Error(body.Error || res.statusText);
+        }
+        return body;
+      });
+    });
+  }
+
+  // streamEvents reads the Server-Sent Events stream with fetch, as
+  // EventSource can't send the Authorization header
+  function streamEvents() {
+    streamAbort = new AbortController();
+    fetch('/api/events', {
+      headers: { 'Authorization': 'Bearer ' + token },
+      signal: streamAbort.signal
+    }).then(function (res) {
+      if (!res.ok) {
+        throw new Error(res.statusText);
+      }
+      var reader = res.body.getReader();
+      var decoder = new TextDecoder();
+      var buffer = '';
+      function read() {
+        return reader.read().then(function (result) {
+          if (result.done) {
+            throw new Error('stream closed');
+          }
+          buffer += decoder.decode(result.value, { stream: true });
+          var end;
+          while ((end = buffer.indexOf('\n\n')) >= 0) {
+            var message = buffer.slice(0, end);
+            buffer = buffer.slice(end + 2);
+            if (message.indexOf('data: ') === 0) {
+              onEvent(JSON.parse(message.slice(6)));
+            }
+          }
+          return read();
+        });
+      }
+      return read();
+    }).catch(function () {
+      if (token && !streamAbort.signal.aborted) {
+        setTimeout(streamEvents, REFRESH_MS);
+      }
+    });
+  }
+
+  //
+  // Rendering
+  //
+
+  function el(tag, className, text) {
+    var node = document.createElement(tag);
+    if (className) {
+      node.className = className;
+    }
+    if (text !== undefined) {
+      node.textContent = text;
+    }
+    return node;
+  }
+
+  function svgEl(tag, attrs) {
+    var node = document.createElementNS('http://www.w3.org/2000/svg', tag);
+    Object.keys(attrs).forEach(function (name) {
+      node.setAttribute(name, attrs[name]);
+    });
+    return node;
+  }
+
+  function badge(yes, text) {
+    return el('span', 'badge ' + (yes ? 'yes' : 'no'), text);
+  }
+
+  function renderServers(http, dns) {
+    var container = document.getElementById('servers');
+    container.textContent = '';
+    [['HTTP', http], ['DNS', dns]].forEach(function (server) {
+      var span = el('span', '', server[0] + ' ');
+      span.appendChild(badge(server[1].Running, server[1].Running ? 'running' : 'not running'));
+      container.appendChild(span);
+    });
+  }
+
+  function renderKeys(id, keys) {
+    var container = document.getElementById(id);
+    container.textContent = '';
+    if (keys.length === 0) {
+      container.appendChild(el('p', 'empty', 'No keys'));
+      return;
+    }
+    keys.forEach(function (key) {
+      container.appendChild(renderKey(key));
+    });
+  }
+
+  function renderKey(key) {
+    var card = el('div', 'key' + (key.Disabled ? ' disabled' : key.Active ? ' active' : ''));
+    card.appendChild(el('h3', '', key.Name + ' (' + key.Type + ')'));
+
+    var dl = el('dl');
+    function row(name, value) {
+      dl.appendChild(el('dt', '', name));
+      var dd = el('dd');
+      if (value instanceof Node) {
+        dd.appendChild(value);
+      } else {
+        dd.textContent = value;
+      }
+      dl.appendChild(dd);
+    }
+
+    if (key.Type === 'http') {
+      row('URL', key.Data.URL);
+      row('FilePath', key.Data.FilePath);
+    } else {
+      row('Hostname', key.Data.Hostname);
+      row('Record Type', key.Data.RecordType);
+      row('Response', key.Data.Response);
+    }
+
+    var active = el('span');
+    if (key.Depends) {
+      active.appendChild(el('span', 'badge', 'DEPENDS ON REQUEST'));
+    } else {
+      active.appendChild(badge(key.Active, key.Active ? 'YES' : 'NO'));
+    }
+    if (key.Reasons) {
+      active.appendChild(document.createTextNode(' (' + key.Reasons + ')'));
+    }
+    row('Active', active);
+    row('Manual', key.Disabled ? 'disabled' : key.On ? 'on' : 'off');
+    row('Hits Today', String(key.Hits));
+    row('Last Hit', key.LastHit || 'never');
+    row('Alerts', key.SendAlerts ? 'Enabled' : 'Disabled');
+    card.appendChild(dl);
+
+    card.appendChild(renderChart(key.HitCounter || {}));
+
+    var hashes = el('details');
+    hashes.appendChild(el('summary', '', 'Hashes and constraints'));
+    Object.keys(key.Hashes || {}).sort().forEach(function (alg) {
+      var p = el('p');
+      p.appendChild(el('strong', '', alg + ': '));
+      p.appendChild(el('code', '', key.Hashes[alg]));
+      hashes.appendChild(p);
+    });
+    Object.keys(key.Constraints || {}).sort().forEach(function (name) {
+      hashes.appendChild(el('p', '', name + ': ' + key.Constraints[name]));
+    });
+    if (key.Expression) {
+      hashes.appendChild(el('p', '', 'Expression: ' + key.Expression));
+    }
+    card.appendChild(hashes);
+
+    var actions = el('div', 'actions');
+    function action(label, name, className, confirmText) {
+      var button = el('button', className || '', label);
+      button.type = 'button';
+      button.addEventListener('click', function () {
+        if (confirmText && !window.confirm(confirmText)) {
+          return;
+        }
+        api('POST', '/api/keys/' + encodeURIComponent(key.Name) + '/' + name)
+          .then(refresh)
+          .catch(showError);
+      });
+      actions.appendChild(button);
+    }
+    if (!key.Disabled) {
+      action(key.On ? 'Turn off' : 'Turn on', key.On ? 'off' : 'on');
+      action('Disable', 'disable', 'danger', 'Disable ' + key.Name + '? Constraints will have no effect and it can\'t be turned back on here.');
+    }
+    action(key.SendAlerts ? 'Disable alerts' : 'Enable alerts', key.SendAlerts ? 'noalert' : 'alert');
+    card.appendChild(actions);
+    return card;
+  }
+
+  // renderChart draws hits per day for the last CHART_DAYS days, HitCounter
+  // days are MM/DD/YYYY
+  function renderChart(hitCounter) {
+    var width = 360;
+    var height = 90;
+    var labelHeight = 14;
+    var days = [];
+    var now = new Date();
+    for (var i = CHART_DAYS - 1; i >= 0; i--) {
+      var day = new Date(now.getFullYear(), now.getMonth(), now.getDate() - i);
+      var mm = ('0' + (day.getMonth() + 1)).slice(-2);
+      var dd = ('0' + day.getDate()).slice(-2);
+      days.push({ label: mm + '/' + dd, hits: hitCounter[mm + '/' + dd + '/' + day.getFullYear()] || 0 });
+    }
+    var max = Math.max.apply(null, days.map(function (d) { return d.hits; }).concat([1]));
+
+    var svg = svgEl('svg', { 'class': 'chart', viewBox: '0 0 ' + width + ' ' + height, preserveAspectRatio: 'none' });
+    var slot = width / days.length;
+    days.forEach(function (d, i) {
+      var barHeight = (height - labelHeight * 2) * d.hits / max;
+      var rect = svgEl('rect', {
+        x: i * slot + 2,
+        y: height - labelHeight - barHeight,
+        width: slot - 4,
+        height: barHeight
+      });
+      var title = svgEl('title', {});
+      title.textContent = d.label + ': ' + d.hits + ' hits';
+      rect.appendChild(title);
+      svg.appendChild(rect);
+
+      if (d.hits > 0) {
+        var count = svgEl('text', { x: i * slot + slot / 2, y: height - labelHeight - barHeight - 2, 'text-anchor': 'middle' });
+        count.textContent = d.hits;
+        svg.appendChild(count);
+      }
+      if (i % 2 === days.length % 2) {
+        var label = svgEl('text', { x: i * slot + slot / 2, y: height - 2, 'text-anchor': 'middle' });
+        label.textContent = d.label;
+        svg.appendChild(label);
+      }
+    });
+    return svg;
+  }
+
+  // onEvent adds a request or a key change to the activity table, key
+  // changes show who made them in place of the source
+  function onEvent(e) {
+    var tbody = document.querySelector('#activity tbody');
+    var change = e.Type === 'keychange';
+    var tr = el('tr', change ? 'change' : e.Active ? 'hit' : '');
+    [
+      new Date(e.Time).toLocaleTimeString(),
+      e.Protocol,
+      change ? e.Operator : e.Source,
+      change ? 'key change' : e.Request,
+      e.Key || '',
+      e.Key && !change ? (e.Active ? 'YES' : 'NO') : '',
+      change ? e.Message : [e.Reasons, e.QueryType, e.UserAgent].filter(Boolean).join(' | ')
+    ].forEach(function (value) {
+      tr.appendChild(el('td', '', value));
+    });
+    tbody.insertBefore(tr, tbody.firstChild);
+    while (tbody.children.length > MAX_ACTIVITY) {
+      tbody.removeChild(tbody.lastChild);
+    }
+    // a burst of hits only needs one refresh
+    if (e.Key && !pendingRefresh) {
+      pendingRefresh = setTimeout(function () {
+        pendingRefresh = null;
+        refresh();
+      }, 500);
+    }
+  }
+
+  //
+  // State
+  //
+
+  function showError(err) {
+    document.getElementById('error').textContent = err.message === 'Unauthorized' ? '' : err.message;
+  }
+
+  function refresh() {
+    return Promise.all([
+      api('GET', '/api/keys'),
+      api('GET', '/api/servers/http'),
+      api('GET', '/api/servers/dns')
+    ]).then(function (results) {
+      document.getElementById('error').textContent = '';
+      renderKeys('http-keys', results[0].Http);
+      renderKeys('dns-keys', results[0].Dns);
+      renderServers(results[1], results[2]);
+    }).catch(showError);
+  }
+
+  function login(newToken) {
+    token = newToken;
+    sessionStorage.setItem('keyserverToken', token);
+    api('GET', '/api/keys').then(function () {
+      document.getElementById('login').classList.add('hidden');
+      document.getElementById('dashboard').classList.remove('hidden');
+      document.getElementById('logout').classList.remove('hidden');
+      refresh();
+      refreshTimer = setInterval(refresh, REFRESH_MS);
+      streamEvents();
+    }).catch(function () {});
+  }
+
+  function logout(message) {
+    token = '';
+    sessionStorage.removeItem('keyserverToken');
+    clearInterval(refreshTimer);
+    if (streamAbort) {
+      streamAbort.abort();
+    }
+    document.getElementById('dashboard').classList.add('hidden');
+    document.getElementById('logout').classList.add('hidden');
+    document.getElementById('servers').textContent = '';
+    document.getElementById('login').classList.remove('hidden');
+    document.getElementById('login-error').textContent = message || '';
+  }
+
+  document.getElementById('login').addEventListener('submit', function (e) {
+    e.preventDefault();
+    login(document.getElementById('token').value.trim());
+  });
+  document.getElementById('logout').addEventListener('click', function () {
+    logout();
+  });
+
+  if (token) {
+    login(token);
+  } else {
+    logout();
+  }
+})();
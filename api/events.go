@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+// eventBuffer is how many events a slow client can fall behind by before
+// it starts missing them
+const eventBuffer = 256
+
+// keepAliveInterval is how often a comment is sent on an idle stream so
+// proxies don't time it out
+const keepAliveInterval = 30 * time.Second
+
+// handleEvents streams servers.Events as Server-Sent Events, one JSON event
+// per message. The optional key and protocol query parameters filter the
+// stream, e.g. /api/events?key=PhishKey&protocol=http
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	key := r.URL.Query().Get("key")
+	protocol := r.URL.Query().Get("protocol")
+
+	events, unsubscribe := servers.Events.Subscribe(eventBuffer)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			if key != "" && !strings.EqualFold(e.Key, key) {
+				continue
+			}
+			if protocol != "" && e.Protocol != protocol {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
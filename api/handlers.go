@@ -0,0 +1,478 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+// keyInfo is a key as returned by the API, Active and Reasons are the same
+// as the CLI's status command shows. When Depends is set the key is active
+// for some requests, Reasons lists the constraints it depends on.
+type keyInfo struct {
+	Name    string
+	Hits    int
+	Active  bool
+	Depends bool `json:",omitempty"`
+	Reasons string
+	*servers.KeyState
+}
+
+// keyList is every key on both servers, sorted by name
+type keyList struct {
+	Http []*keyInfo
+	Dns  []*keyInfo
+}
+
+// newKey is the body for creating a key
+type newKey struct {
+	Name        string
+	Type        string
+	Data        map[string]string
+	Constraints map[string]string
+	Expression  string
+	On          bool
+	Disabled    bool
+	SendAlerts  bool
+}
+
+// keyChanges is the body for editing a key. Only the given fields change, a
+// constraint set to "" is removed and a new Name renames the key.
+type keyChanges struct {
+	Name        string
+	Data        map[string]string
+	Constraints map[string]string
+	Expression  *string
+}
+
+// editResult reports whether an edit changed the key's hashes, payloads
+// encrypted with the old hash won't decrypt with the new one
+type editResult struct {
+	HashChanged bool
+	Key         *keyInfo
+}
+
+// serverStatus is a server's state and settings as returned by the API
+type serverStatus struct {
+	Running  bool
+	Keys     int
+	Settings map[string]*servers.ServerSetting
+}
+
+// settingValue is the body for changing a server setting
+type settingValue struct {
+	Value string
+}
+
+// keyRef is a key found on one of the servers
+type keyRef struct {
+	name string
+	key  *servers.Key
+	http bool
+}
+
+// server is what the API needs from both the HTTP and DNS servers
+type server interface {
+	IsRunning() bool
+	KeyCount() int
+	Start() error
+	Stop() error
+	SetSetting(name, value string) error
+	UnsetSetting(name string) error
+	Settings() map[string]*servers.ServerSetting
+	SettingValues() map[string]string
+	Changed()
+}
+
+//
+// Key handlers
+//
+
+// handleKeys routes /api/keys requests, parts is the path after /api/keys
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0:
+		switch r.Method {
+		case http.MethodGet:
+			s.listKeys(w)
+		case http.MethodPost:
+			s.createKey(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case len(parts) == 1:
+		ref := s.findKey(parts[0])
+		if ref == nil {
+			writeError(w, http.StatusNotFound, "No key named "+parts[0])
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, ref.info())
+		case http.MethodPut:
+			s.editKey(w, r, ref)
+		case http.MethodDelete:
+			s.removeKey(w, ref)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case len(parts) == 2:
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		ref := s.findKey(parts[0])
+		if ref == nil {
+			writeError(w, http.StatusNotFound, "No key named "+parts[0])
+			return
+		}
+		s.keyAction(w, ref, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (s *Server) listKeys(w http.ResponseWriter) {
+	list := &keyList{
+		Http: keyInfos(s.Http.Keys(), true),
+		Dns:  keyInfos(s.Dns.Keys(), false),
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createKey builds the key the same way keys are restored from state, then
+// adds it so it's validated and hashed like one added from the CLI
+func (s *Server) createKey(w http.ResponseWriter, r *http.Request) {
+	req := &newKey{}
+	if err := readJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "Key Name is required")
+		return
+	}
+	if s.findKey(req.Name) != nil {
+		writeError(w, http.StatusConflict, "Key name already exists!")
+		return
+	}
+	if err := checkData(req.Type, req.Data); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ks := &servers.KeyState{
+		Type:        req.Type,
+		On:          req.On,
+		Disabled:    req.Disabled,
+		SendAlerts:  req.SendAlerts,
+		Data:        req.Data,
+		Constraints: req.Constraints,
+		Expression:  req.Expression,
+	}
+	k, err := ks.ToKey()
+	if err == nil {
+		if req.Type == "http" {
+			err = s.Http.AddKey(k, req.Name)
+		} else {
+			err = s.Dns.AddKey(k, req.Name)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error adding key: "+err.Error())
+		return
+	}
+
+	ref := &keyRef{name: req.Name, key: k, http: req.Type == "http"}
+	ref.keyChange("add", "", servers.AuditState(k))
+	s.changed(ref)
+	writeJSON(w, http.StatusCreated, ref.info())
+}
+
+// editKey applies the changes to a copy of the key and swaps it in with
+// EditKey, same as the CLI's edit command
+func (s *Server) editKey(w http.ResponseWriter, r *http.Request, ref *keyRef) {
+	req := &keyChanges{}
+	if err := readJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkData(ref.key.Type, req.Data); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newName := ref.name
+	if req.Name != "" && req.Name != ref.name {
+		if other := s.findKey(req.Name); other != nil && other.key != ref.key {
+			writeError(w, http.StatusConflict, "Key name already exists!")
+			return
+		}
+		newName = req.Name
+	}
+
+	ks := ref.key.ToState()
+	for name, value := range req.Data {
+		ks.Data[name] = value
+	}
+	for name, value := range req.Constraints {
+		ks.Constraints[name] = value
+	}
+	if req.Expression != nil {
+		ks.Expression = *req.Expression
+	}
+
+	before := servers.AuditState(ref.key)
+	var hashChanged bool
+	k, err := ks.ToKey()
+	if err == nil {
+		if ref.http {
+			hashChanged, err = s.Http.EditKey(ref.name, newName, k)
+		} else {
+			hashChanged, err = s.Dns.EditKey(ref.name, newName, k)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error saving key: "+err.Error())
+		return
+	}
+
+	if newName != ref.name {
+		ref.keyChange("rename", ref.name, newName)
+	}
+	edited := &keyRef{name: newName, key: k, http: ref.http}
+	edited.keyChange("edit", before, servers.AuditState(k))
+	s.changed(edited)
+	writeJSON(w, http.StatusOK, &editResult{HashChanged: hashChanged, Key: edited.info()})
+}
+
+func (s *Server) removeKey(w http.ResponseWriter, ref *keyRef) {
+	before := servers.AuditState(ref.key)
+	if ref.http {
+		s.Http.RemoveKey(ref.name)
+	} else {
+		s.Dns.RemoveKey(ref.name)
+	}
+	ref.keyChange("remove", before, "")
+	s.changed(ref)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keyAction handles the same per key commands as the CLI's main menu
+func (s *Server) keyAction(w http.ResponseWriter, ref *keyRef, action string) {
+	var state func(*servers.Key) string
+	var change func()
+	switch action {
+	case "on", "off":
+		state = servers.ManualState
+		change = func() { ref.key.SetOn(action == "on") }
+	case "disable":
+		state = servers.ManualState
+		change = ref.key.Disable
+	case "alert", "noalert":
+		state = servers.AlertState
+		change = func() { ref.key.SetSendAlerts(action == "alert") }
+	case "clearhits":
+		state = servers.HitState
+		change = ref.key.ClearHits
+	default:
+		writeError(w, http.StatusNotFound, "Unknown key action: "+action)
+		return
+	}
+	before := state(ref.key)
+	change()
+	ref.keyChange(action, before, state(ref.key))
+	s.changed(ref)
+	writeJSON(w, http.StatusOK, ref.info())
+}
+
+//
+// Server handlers
+//
+
+// handleServers routes /api/servers requests, parts is the path after /api/servers
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	srv := s.server(parts[0])
+	if srv == nil {
+		writeError(w, http.StatusNotFound, "Unknown server: "+parts[0])
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, &serverStatus{
+			Running:  srv.IsRunning(),
+			Keys:     srv.KeyCount(),
+			Settings: srv.Settings(),
+		})
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		s.serverAction(w, parts[0], srv, parts[1])
+	case len(parts) == 3 && parts[1] == "settings" && r.Method == http.MethodPut:
+		req := &settingValue{}
+		if err := readJSON(r, req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		before := srv.SettingValues()
+		if err := srv.SetSetting(parts[2], req.Value); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		servers.SettingChanges(Operator, parts[0], "set", before, srv.SettingValues())
+		srv.Changed()
+		writeJSON(w, http.StatusOK, srv.Settings())
+	case len(parts) == 3 && parts[1] == "settings" && r.Method == http.MethodDelete:
+		before := srv.SettingValues()
+		if err := srv.UnsetSetting(parts[2]); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		servers.SettingChanges(Operator, parts[0], "unset", before, srv.SettingValues())
+		srv.Changed()
+		writeJSON(w, http.StatusOK, srv.Settings())
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (s *Server) serverAction(w http.ResponseWriter, name string, srv server, action string) {
+	var err error
+	switch action {
+	case "start":
+		err = s.startServer(name, srv)
+	case "stop":
+		err = s.stopServer(name, srv)
+	case "restart":
+		if srv.IsRunning() {
+			err = s.stopServer(name, srv)
+		}
+		if err == nil {
+			err = s.startServer(name, srv)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "Unknown server action: "+action)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &serverStatus{
+		Running:  srv.IsRunning(),
+		Keys:     srv.KeyCount(),
+		Settings: srv.Settings(),
+	})
+}
+
+//
+// Helpers
+//
+
+// startServer starts the server and records it in the audit log
+func (s *Server) startServer(name string, srv server) error {
+	if err := srv.Start(); err != nil {
+		return err
+	}
+	servers.ServerChange(Operator, name, "start")
+	return nil
+}
+
+func (s *Server) stopServer(name string, srv server) error {
+	if err := srv.Stop(); err != nil {
+		return err
+	}
+	servers.ServerChange(Operator, name, "stop")
+	return nil
+}
+
+// server returns the server called name ("http" or "dns")
+func (s *Server) server(name string) server {
+	switch name {
+	case "http":
+		return s.Http
+	case "dns":
+		return s.Dns
+	}
+	return nil
+}
+
+// findKey searches both servers for a key name case insensitively like the
+// CLI does, returning nil if it doesn't exist
+func (s *Server) findKey(name string) *keyRef {
+	if found := s.Http.FindKey(name); found != "" {
+		if k := s.Http.GetKey(found); k != nil {
+			return &keyRef{name: found, key: k, http: true}
+		}
+	}
+	if found := s.Dns.FindKey(name); found != "" {
+		if k := s.Dns.GetKey(found); k != nil {
+			return &keyRef{name: found, key: k}
+		}
+	}
+	return nil
+}
+
+func (s *Server) changed(ref *keyRef) {
+	if ref.http {
+		s.Http.Changed()
+	} else {
+		s.Dns.Changed()
+	}
+}
+
+// keyChange records, logs and broadcasts a change made to the key through
+// the API, see servers.KeyChange
+func (ref *keyRef) keyChange(action, before, after string) {
+	keyType := "dns"
+	if ref.http {
+		keyType = "http"
+	}
+	servers.KeyChange(Operator, Operator, keyType, ref.name, action, before, after)
+}
+
+// info returns the key's state without the pinned file contents, which
+// could be large and are already on disk
+func (ref *keyRef) info() *keyInfo {
+	ks := ref.key.ToState()
+	ks.Content = nil
+	status, reasons := ref.key.Status()
+	return &keyInfo{
+		Name:     ref.name,
+		Hits:     ref.key.GetHits(),
+		Active:   status == servers.StatusActive,
+		Depends:  status == servers.StatusDepends,
+		Reasons:  reasons,
+		KeyState: ks,
+	}
+}
+
+func keyInfos(keys map[string]*servers.Key, isHttp bool) []*keyInfo {
+	infos := []*keyInfo{}
+	for name, k := range keys {
+		ref := &keyRef{name: name, key: k, http: isHttp}
+		infos = append(infos, ref.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// checkData makes sure every Data name exists for the key type, ToKey
+// silently ignores unknown ones
+func checkData(keyType string, data map[string]string) error {
+	k := servers.NewKey(keyType)
+	if k == nil {
+		return errors.New("Unknown key type: " + keyType)
+	}
+	for name := range data {
+		if _, ok := k.Data[name]; !ok {
+			return errors.New("Unknown key data: " + name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/leoloobeek/keyserver/servers"
+	logging "github.com/op/go-logging"
+)
+
+func init() {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+}
+
+// request sends a request to the API with the test token
+func request(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestCreateDisabledKey(t *testing.T) {
+	s := New(servers.GetHttpServer(), servers.GetDnsServer(), "token")
+	s.Dns.SetSetting("Domain", "example.com")
+
+	w := request(s, http.MethodPost, "/api/keys", `{"Name":"mail","Type":"dns","Data":{"Hostname":"mail","Response":"key"},"On":true,"Disabled":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Creating the key: %d %s", w.Code, w.Body)
+	}
+	k := s.Dns.GetKey("mail")
+	if k == nil || !k.IsDisabled() {
+		t.Error("Key created from the API wasn't disabled")
+	}
+}
+
+func TestSettingsResponseIsACopy(t *testing.T) {
+	s := New(servers.GetHttpServer(), servers.GetDnsServer(), "token")
+
+	w := request(s, http.MethodPut, "/api/servers/dns/settings/DefaultTTL", `{"Value":"120"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Setting DefaultTTL: %d %s", w.Code, w.Body)
+	}
+	settings := map[string]*servers.ServerSetting{}
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings["DefaultTTL"] == nil || settings["DefaultTTL"].Value != "120" {
+		t.Error("Response doesn't have the new DefaultTTL")
+	}
+
+	status := s.Dns.Settings()
+	status["DefaultTTL"].Value = "1"
+	if s.Dns.Setting("DefaultTTL") != "120" {
+		t.Error("Changing the returned settings changed the server's")
+	}
+}
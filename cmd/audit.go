@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+const (
+	// auditRecent is how many entries `audit` shows on its own
+	auditRecent = 20
+
+	// auditValueWidth is how much of a value is shown, the whole value is
+	// kept in the audit log itself
+	auditValueWidth = 40
+
+	auditTimeFormat = "2006-01-02 15:04:05 MST"
+)
+
+// printAudit prints the latest entries, or every entry for a key along with
+// when it was turned on
+func (c *CmdInfo) printAudit(key string) {
+	entries, err := servers.Audit.Entries()
+	if err != nil {
+		c.printf("[!] Error reading the audit log: %s\n", err)
+		return
+	}
+
+	if key == "" {
+		if len(entries) > auditRecent {
+			entries = entries[len(entries)-auditRecent:]
+		}
+		for _, e := range entries {
+			c.printAuditEntry(e)
+		}
+		return
+	}
+
+	keyEntries := servers.KeyAuditEntries(entries, key)
+	if len(keyEntries) == 0 {
+		c.printf("[!] No audit entries for %s\n", key)
+		return
+	}
+	for _, e := range keyEntries {
+		c.printAuditEntry(e)
+	}
+
+	c.println()
+	windows := servers.KeyLiveWindows(entries, key)
+	if len(windows) == 0 {
+		c.printf("[*] %s was never manually turned on\n", key)
+	} else {
+		c.printf("[*] %s was manually turned on:\n", key)
+		for _, w := range windows {
+			to := "now"
+			if !w.To.IsZero() {
+				to = w.To.Local().Format(auditTimeFormat)
+			}
+			c.printf("\t%s - %s\n", w.From.Local().Format(auditTimeFormat), to)
+		}
+	}
+	c.println("[*] Keys are also live whenever their constraints match, see the add and edit entries for when they changed")
+}
+
+func (c *CmdInfo) printAuditEntry(e *servers.AuditEntry) {
+	target := strings.ToUpper(e.Protocol) + " server"
+	if e.Key != "" {
+		target = strings.ToUpper(e.Protocol) + " key " + e.Key
+	} else if e.Setting != "" {
+		target = strings.ToUpper(e.Protocol) + " setting " + e.Setting
+	}
+	change := e.Action
+	if values := auditChange(e); values != "" {
+		change += ": " + values
+	}
+	c.printf("%4d  %s  %-10s  %s  %s\n", e.Seq, e.Time.Local().Format(auditTimeFormat), e.Operator, target, change)
+}
+
+// auditChange describes the values in an entry. Keys' settings are shortened
+// to what changed, or what they were set to when added or removed.
+func auditChange(e *servers.AuditEntry) string {
+	before, after := keySettings(e.Before), keySettings(e.After)
+	switch {
+	case before == nil && after == nil:
+		if e.Before == "" && e.After == "" {
+			return ""
+		}
+		return auditValue(e.Before) + " -> " + auditValue(e.After)
+	case before == nil:
+		if e.Before != "" {
+			return "from " + e.Before + ", " + listSettings(after)
+		}
+		return listSettings(after)
+	case after == nil:
+		return listSettings(before)
+	}
+
+	var changes []string
+	for _, name := range settingNames(before, after) {
+		if before[name] != after[name] {
+			changes = append(changes, name+" "+auditValue(before[name])+" -> "+auditValue(after[name]))
+		}
+	}
+	if len(changes) == 0 {
+		return "no changes"
+	}
+	return strings.Join(changes, ", ")
+}
+
+// keySettings flattens a servers.AuditState value, nil if it isn't one
+func keySettings(value string) map[string]string {
+	if !strings.HasPrefix(value, "{") {
+		return nil
+	}
+	ks := &servers.KeyState{}
+	if json.Unmarshal([]byte(value), ks) != nil {
+		return nil
+	}
+	settings := make(map[string]string)
+	for name, v := range ks.Data {
+		settings[name] = v
+	}
+	for name, v := range ks.Constraints {
+		settings[name] = v
+	}
+	settings["Expression"] = ks.Expression
+	var hashes []string
+	for _, alg := range settingNames(ks.Hashes) {
+		hashes = append(hashes, ks.Hashes[alg])
+	}
+	settings["Hashes"] = strings.Join(hashes, ",")
+	return settings
+}
+
+func listSettings(settings map[string]string) string {
+	var list []string
+	for _, name := range settingNames(settings) {
+		if settings[name] != "" && name != "Hashes" {
+			list = append(list, name+"="+auditValue(settings[name]))
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// settingNames returns the names in all the maps, sorted
+func settingNames(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range maps {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func auditValue(value string) string {
+	if value == "" {
+		return "''"
+	}
+	if len(value) > auditValueWidth {
+		return value[:auditValueWidth] + "..."
+	}
+	return value
+}
+
+// verifyAudit checks the audit log's hash chain, and that anchor, a hash
+// from an earlier check, is still in it
+func (c *CmdInfo) verifyAudit(anchor string) {
+	path := servers.Audit.Path()
+	if path == "" {
+		c.println("[!] The audit log isn't enabled")
+		return
+	}
+	n, head, err := servers.VerifyAuditLog(path, anchor)
+	if err != nil {
+		c.printf("[!] Audit log has been tampered with: %s\n", err)
+		if n > 0 {
+			c.printf("[*] The first %d entries are intact, up to hash %s\n", n, head)
+		}
+		return
+	}
+	c.printf("[+] Audit log verified, %d entries\n", n)
+	if head != "" {
+		c.printf("[*] Latest hash: %s\n", head)
+		c.println("[*] Note it down, `audit verify <hash>` checks no entries were removed after it")
+	}
+}
@@ -4,17 +4,18 @@ package cmd
 // for pointing me to github.com/chzyer/readline and having a good example to work off of
 
 import (
-	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/chzyer/readline"
-	"github.com/leoloobeek/keyserver/logger"
 	"github.com/leoloobeek/keyserver/servers"
+	"github.com/leoloobeek/keyserver/stager"
 )
 
 // CmdInfo holds all commands for a menu
@@ -24,14 +25,41 @@ type CmdInfo struct {
 	TabCompleters map[string]*readline.Instance
 	HttpServer    *servers.HttpServer
 	DnsServer     *servers.DnsServer
+	EditKey       string          // key the key menu opens with, empty for a new key
+	Script        []string        // commands to run before reading from the prompt
+	Operator      string          // who is at this console, shown with key changes
+	Session       string          // where changes are made from, an operator may have several sessions
+	Out           io.Writer       // the operator's terminal, stdout if nil
+	scripted      bool            // whether the current command came from Script
+	terminal      *remoteTerminal // the client's terminal for team server sessions
+}
+
+// out returns where command output goes
+func (c *CmdInfo) out() io.Writer {
+	if c.Out != nil {
+		return c.Out
+	}
+	return os.Stdout
+}
+
+func (c *CmdInfo) printf(format string, a ...interface{}) {
+	fmt.Fprintf(c.out(), format, a...)
+}
+
+func (c *CmdInfo) println(a ...interface{}) {
+	fmt.Fprintln(c.out(), a...)
+}
+
+func (c *CmdInfo) print(a ...interface{}) {
+	fmt.Fprint(c.out(), a...)
 }
 
 func (c *CmdInfo) MainMenu() {
 	menuItems := c.getMainMenuItems()
-	c.TabCompleters[c.MenuType].Config.AutoComplete = menuItems.Completer
+	c.setCompleter(menuItems.Completer)
 
 	for {
-		line, err := c.TabCompleters[c.MenuType].Readline()
+		line, err := c.readLine()
 		if err == readline.ErrInterrupt {
 			if len(line) == 0 {
 				break
@@ -54,7 +82,7 @@ func (c *CmdInfo) MainMenu() {
 				} else if strings.ToLower(words[1]) == "http" {
 					c.MenuType = "Http"
 				} else {
-					fmt.Printf("[!] Unknown menu type: %s\n", words[1])
+					c.printf("[!] Unknown menu type: %s\n", words[1])
 				}
 				return
 			}
@@ -62,50 +90,50 @@ func (c *CmdInfo) MainMenu() {
 			errorMsg := "[!] Either start 'http' or 'dns'"
 			if len(words) == 2 {
 				if strings.ToLower(words[1]) == "http" {
-					startHttpServer(c.HttpServer)
+					c.startHttpServer(c.HttpServer)
 				} else if strings.ToLower(words[1]) == "dns" {
-					startDnsServer(c.DnsServer)
+					c.startDnsServer(c.DnsServer)
 				} else {
-					fmt.Println(errorMsg)
+					c.println(errorMsg)
 				}
 			} else {
-				fmt.Println(errorMsg)
+				c.println(errorMsg)
 			}
 		case "stop":
 			errorMsg := "[!] Either stop 'http' or 'dns'"
 			if len(words) == 2 {
 				if strings.ToLower(words[1]) == "http" {
-					stopHttpServer(c.HttpServer)
+					c.stopHttpServer(c.HttpServer)
 				} else if strings.ToLower(words[1]) == "dns" {
-					stopDnsServer(c.DnsServer)
+					c.stopDnsServer(c.DnsServer)
 				} else {
-					fmt.Println(errorMsg)
+					c.println(errorMsg)
 				}
 			} else {
-				fmt.Println(errorMsg)
+				c.println(errorMsg)
 			}
 		case "restart":
 			errorMsg := "[!] Either restart 'http' or 'dns'"
 			if len(words) == 2 {
 				if strings.ToLower(words[1]) == "http" {
-					stopHttpServer(c.HttpServer)
-					if !c.HttpServer.Running {
-						startHttpServer(c.HttpServer)
+					c.stopHttpServer(c.HttpServer)
+					if !c.HttpServer.IsRunning() {
+						c.startHttpServer(c.HttpServer)
 					}
 				} else if strings.ToLower(words[1]) == "dns" {
-					stopDnsServer(c.DnsServer)
-					if !c.DnsServer.Running {
-						startDnsServer(c.DnsServer)
+					c.stopDnsServer(c.DnsServer)
+					if !c.DnsServer.IsRunning() {
+						c.startDnsServer(c.DnsServer)
 					}
 				} else {
-					fmt.Println(errorMsg)
+					c.println(errorMsg)
 				}
 			} else {
-				fmt.Println(errorMsg)
+				c.println(errorMsg)
 			}
 		case "new":
 			if len(words) != 2 {
-				fmt.Println("[!] Either create an 'httpkey' or 'dnskey'")
+				c.println("[!] Either create an 'httpkey' or 'dnskey'")
 			} else {
 				if words[1] == "httpkey" {
 					c.MenuType = "HttpKey"
@@ -116,173 +144,272 @@ func (c *CmdInfo) MainMenu() {
 					return
 				}
 			}
+		case "edit":
+			if len(words) != 2 {
+				c.println("[!] Use `edit <keyname>` to change an existing key")
+			} else {
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" {
+					c.EditKey = httpKeyFound
+					c.MenuType = "HttpKey"
+					return
+				}
+				if dnsKeyFound != "" {
+					c.EditKey = dnsKeyFound
+					c.MenuType = "DnsKey"
+					return
+				}
+			}
+		case "clone":
+			if len(words) != 3 {
+				c.println("[!] Use `clone <src> <dst>` to copy a key to a new key")
+			} else {
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpInUse, dnsInUse := findKey(words[2], c.HttpServer, c.DnsServer); httpInUse != "" || dnsInUse != "" {
+					c.printf("[!] Key name %s is already in use\n", words[2])
+				} else if httpKeyFound != "" {
+					if err := c.HttpServer.CloneKey(httpKeyFound, words[2]); err != nil {
+						c.printf("[!] Error cloning key: %s\n", err)
+					} else {
+						servers.KeyChange(c.Operator, c.Session, "http", words[2], "clone", httpKeyFound, auditState(c.HttpServer.GetKey(words[2])))
+						c.HttpServer.Changed()
+						c.printf("[+] Cloned %s to %s, use `edit %s` to change it\n", httpKeyFound, words[2], words[2])
+					}
+				} else if dnsKeyFound != "" {
+					if err := c.DnsServer.CloneKey(dnsKeyFound, words[2]); err != nil {
+						c.printf("[!] Error cloning key: %s\n", err)
+					} else {
+						servers.KeyChange(c.Operator, c.Session, "dns", words[2], "clone", dnsKeyFound, auditState(c.DnsServer.GetKey(words[2])))
+						c.DnsServer.Changed()
+						c.printf("[+] Cloned %s to %s, use `edit %s` to change it\n", dnsKeyFound, words[2], words[2])
+					}
+				} else {
+					c.printf("[!] No key named %s\n", words[1])
+				}
+			}
+		case "audit":
+			switch {
+			case len(words) == 1:
+				c.printAudit("")
+			case strings.ToLower(words[1]) == "verify" && len(words) <= 3:
+				c.verifyAudit(strings.Join(words[2:], ""))
+			case len(words) == 2:
+				c.printAudit(words[1])
+			default:
+				c.println("[!] Use `audit`, `audit <keyname>` or `audit verify [hash]`")
+			}
 		case "status":
-			fmt.Println()
+			c.println()
 			running := "not running"
-			if c.HttpServer.Running {
+			if c.HttpServer.IsRunning() {
 				running = "running"
 			}
-			fmt.Printf("HTTP: (%d keys, %s)\n", len(c.HttpServer.Keys), running)
-			printKeys(c.HttpServer.Keys)
+			c.printf("HTTP: (%d keys, %s)\n", c.HttpServer.KeyCount(), running)
+			c.printKeys(c.HttpServer.Keys())
 
 			running = "not running"
-			if c.DnsServer.Running {
+			if c.DnsServer.IsRunning() {
 				running = "running"
 			}
-			fmt.Printf("DNS: (%d keys, %s)\n", len(c.DnsServer.Keys), running)
-			printKeys(c.DnsServer.Keys)
-			fmt.Println()
+			c.printf("DNS: (%d keys, %s)\n", c.DnsServer.KeyCount(), running)
+			c.printKeys(c.DnsServer.Keys())
+			c.println()
 		case "info":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `info <keyname>` to view details about a specific key")
+				c.println("[!] Use `info <keyname>` to view details about a specific key")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					printKey(c.HttpServer.Keys[httpKeyFound], httpKeyFound)
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if key := c.HttpServer.GetKey(httpKeyFound); key != nil {
+					c.printKey(key, httpKeyFound)
 				}
-				if dnsKeyFound != "" {
-					printKey(c.DnsServer.Keys[dnsKeyFound], dnsKeyFound)
+				if key := c.DnsServer.GetKey(dnsKeyFound); key != nil {
+					c.printKey(key, dnsKeyFound)
 				}
 			}
 		case "on":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `on <keyname>` to manually turn on a key")
+				c.println("[!] Use `on <keyname>` to manually turn on a key")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					c.HttpServer.Keys[httpKeyFound].On = true
-					logger.Log.Noticef("[KEYCHANGE] - HTTP Key '%s' has been turned on!", httpKeyFound)
-					if !c.HttpServer.Running {
-						fmt.Println("[-] HTTP Server isn't running...")
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" && c.changeKey("http", httpKeyFound, "on", c.HttpServer.GetKey(httpKeyFound), servers.ManualState, func(k *servers.Key) { k.SetOn(true) }) {
+					c.HttpServer.Changed()
+					if !c.HttpServer.IsRunning() {
+						c.println("[-] HTTP Server isn't running...")
 					}
 				}
-				if dnsKeyFound != "" {
-					c.DnsServer.Keys[dnsKeyFound].On = true
-					logger.Log.Noticef("[KEYCHANGE] - DNS Key '%s' has been turned on!", dnsKeyFound)
-					if !c.DnsServer.Running {
-						fmt.Println("[-] DNS Server isn't running...")
+				if dnsKeyFound != "" && c.changeKey("dns", dnsKeyFound, "on", c.DnsServer.GetKey(dnsKeyFound), servers.ManualState, func(k *servers.Key) { k.SetOn(true) }) {
+					c.DnsServer.Changed()
+					if !c.DnsServer.IsRunning() {
+						c.println("[-] DNS Server isn't running...")
 					}
 				}
 			}
 		case "off":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `off <keyname>` to manually turn off a key, constraints will still turn it on")
+				c.println("[!] Use `off <keyname>` to manually turn off a key, constraints will still turn it on")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					c.HttpServer.Keys[httpKeyFound].On = false
-					logger.Log.Noticef("[KEYCHANGE] - HTTP Key '%s' has been turned off!", httpKeyFound)
-					if !c.HttpServer.Running {
-						fmt.Println("[-] HTTP Server isn't running...")
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" && c.changeKey("http", httpKeyFound, "off", c.HttpServer.GetKey(httpKeyFound), servers.ManualState, func(k *servers.Key) { k.SetOn(false) }) {
+					c.HttpServer.Changed()
+					if !c.HttpServer.IsRunning() {
+						c.println("[-] HTTP Server isn't running...")
 					}
 				}
-				if dnsKeyFound != "" {
-					c.DnsServer.Keys[dnsKeyFound].On = false
-					logger.Log.Noticef("[KEYCHANGE] - DNS Key '%s' has been turned off!", dnsKeyFound)
-					if !c.DnsServer.Running {
-						fmt.Println("[-] DNS Server isn't running...")
+				if dnsKeyFound != "" && c.changeKey("dns", dnsKeyFound, "off", c.DnsServer.GetKey(dnsKeyFound), servers.ManualState, func(k *servers.Key) { k.SetOn(false) }) {
+					c.DnsServer.Changed()
+					if !c.DnsServer.IsRunning() {
+						c.println("[-] DNS Server isn't running...")
 					}
 				}
 			}
 		case "disable":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `disable <keyname>` to disable a key indefinitely")
+				c.println("[!] Use `disable <keyname>` to disable a key indefinitely")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					c.HttpServer.Keys[httpKeyFound].On = false
-					c.HttpServer.Keys[httpKeyFound].Disabled = true
-					logger.Log.Noticef("[KEYCHANGE] - HTTP Key %s has been turned diabled! Constraints will have no effect.", httpKeyFound)
-					if !c.HttpServer.Running {
-						fmt.Println("[-] HTTP Server isn't running...")
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" && c.changeKey("http", httpKeyFound, "disable", c.HttpServer.GetKey(httpKeyFound), servers.ManualState, func(k *servers.Key) { k.Disable() }) {
+					c.HttpServer.Changed()
+					if !c.HttpServer.IsRunning() {
+						c.println("[-] HTTP Server isn't running...")
 					}
 				}
-				if dnsKeyFound != "" {
-					c.DnsServer.Keys[dnsKeyFound].On = false
-					c.DnsServer.Keys[dnsKeyFound].Disabled = true
-					logger.Log.Noticef("[KEYCHANGE] - DNS Key %s has been turned disabled! Constraints will have no effect.", dnsKeyFound)
-					if !c.DnsServer.Running {
-						fmt.Println("[-] DNS Server isn't running...")
+				if dnsKeyFound != "" && c.changeKey("dns", dnsKeyFound, "disable", c.DnsServer.GetKey(dnsKeyFound), servers.ManualState, func(k *servers.Key) { k.Disable() }) {
+					c.DnsServer.Changed()
+					if !c.DnsServer.IsRunning() {
+						c.println("[-] DNS Server isn't running...")
 					}
 				}
 			}
 		case "alert":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `alert <keyname>` to turn on alerting for a key")
+				c.println("[!] Use `alert <keyname>` to turn on alerting for a key")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					c.HttpServer.Keys[httpKeyFound].SendAlerts = true
-					fmt.Printf("[*] Alerting for %s enabled\n", httpKeyFound)
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" && c.changeKey("http", httpKeyFound, "alert", c.HttpServer.GetKey(httpKeyFound), servers.AlertState, func(k *servers.Key) { k.SetSendAlerts(true) }) {
+					c.HttpServer.Changed()
+					c.printf("[*] Alerting for %s enabled\n", httpKeyFound)
 				}
-				if dnsKeyFound != "" {
-					c.DnsServer.Keys[dnsKeyFound].SendAlerts = true
-					fmt.Printf("[*] Alerting for %s enabled\n", dnsKeyFound)
+				if dnsKeyFound != "" && c.changeKey("dns", dnsKeyFound, "alert", c.DnsServer.GetKey(dnsKeyFound), servers.AlertState, func(k *servers.Key) { k.SetSendAlerts(true) }) {
+					c.DnsServer.Changed()
+					c.printf("[*] Alerting for %s enabled\n", dnsKeyFound)
 				}
 			}
 		case "noalert":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `noalert <keyname>` to turn off alerting for a key")
+				c.println("[!] Use `noalert <keyname>` to turn off alerting for a key")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					c.HttpServer.Keys[httpKeyFound].SendAlerts = false
-					fmt.Printf("[*] Alerting for %s disabled\n", httpKeyFound)
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" && c.changeKey("http", httpKeyFound, "noalert", c.HttpServer.GetKey(httpKeyFound), servers.AlertState, func(k *servers.Key) { k.SetSendAlerts(false) }) {
+					c.HttpServer.Changed()
+					c.printf("[*] Alerting for %s disabled\n", httpKeyFound)
 				}
-				if dnsKeyFound != "" {
-					c.DnsServer.Keys[dnsKeyFound].SendAlerts = false
-					fmt.Printf("[*] Alerting for %s disabled\n", dnsKeyFound)
+				if dnsKeyFound != "" && c.changeKey("dns", dnsKeyFound, "noalert", c.DnsServer.GetKey(dnsKeyFound), servers.AlertState, func(k *servers.Key) { k.SetSendAlerts(false) }) {
+					c.DnsServer.Changed()
+					c.printf("[*] Alerting for %s disabled\n", dnsKeyFound)
 				}
 			}
 		case "remove":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `remove <keyname>` to remove a key")
+				c.println("[!] Use `remove <keyname>` to remove a key")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
 				if httpKeyFound != "" {
-					if response := askForPermission("[>] Remove this key? [y/N] "); response {
-						delete(c.HttpServer.Keys, httpKeyFound)
+					if response := c.confirm("[>] Remove this key? [y/N] "); response {
+						before := auditState(c.HttpServer.GetKey(httpKeyFound))
+						if c.HttpServer.RemoveKey(httpKeyFound) {
+							c.HttpServer.Changed()
+							servers.KeyChange(c.Operator, c.Session, "http", httpKeyFound, "remove", before, "")
+						}
 					}
 				}
 				if dnsKeyFound != "" {
-					if response := askForPermission("[>] Remove this key? [y/N] "); response {
-						delete(c.DnsServer.Keys, dnsKeyFound)
+					if response := c.confirm("[>] Remove this key? [y/N] "); response {
+						before := auditState(c.DnsServer.GetKey(dnsKeyFound))
+						if c.DnsServer.RemoveKey(dnsKeyFound) {
+							c.DnsServer.Changed()
+							servers.KeyChange(c.Operator, c.Session, "dns", dnsKeyFound, "remove", before, "")
+						}
 					}
 				}
 			}
 		case "clearhits":
 			if len(words) != 2 {
-				fmt.Println("[!] Use `clearhits <keyname>` to remove a key")
+				c.println("[!] Use `clearhits <keyname>` to remove a key")
 			} else {
-				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer.Keys, c.DnsServer.Keys)
-				if httpKeyFound != "" {
-					c.HttpServer.Keys[httpKeyFound].ClearHits()
+				httpKeyFound, dnsKeyFound := findKey(words[1], c.HttpServer, c.DnsServer)
+				if httpKeyFound != "" && c.changeKey("http", httpKeyFound, "clearhits", c.HttpServer.GetKey(httpKeyFound), servers.HitState, func(k *servers.Key) { k.ClearHits() }) {
+					c.HttpServer.Changed()
 				}
-				if dnsKeyFound != "" {
-					c.DnsServer.Keys[dnsKeyFound].ClearHits()
+				if dnsKeyFound != "" && c.changeKey("dns", dnsKeyFound, "clearhits", c.DnsServer.GetKey(dnsKeyFound), servers.HitState, func(k *servers.Key) { k.ClearHits() }) {
+					c.DnsServer.Changed()
 				}
 			}
+		case "export":
+			if len(words) != 2 {
+				c.println("[!] Use `export <file>` to save all keys and settings to a JSON or YAML file")
+			} else {
+				if err := servers.ExportEngagement(words[1], c.HttpServer, c.DnsServer); err != nil {
+					c.printf("[!] Error exporting keys: %s\n", err)
+				} else {
+					c.printf("[*] Exported %d HTTP and %d DNS keys to %s\n", c.HttpServer.KeyCount(), c.DnsServer.KeyCount(), words[1])
+				}
+			}
+		case "import":
+			if len(words) != 2 {
+				c.println("[!] Use `import <file>` to load keys and settings from a JSON or YAML file")
+			} else {
+				httpSettings, dnsSettings := c.HttpServer.SettingValues(), c.DnsServer.SettingValues()
+				result, err := servers.ImportEngagement(words[1], c.HttpServer, c.DnsServer)
+				if err != nil {
+					c.printf("[!] Error importing keys: %s\n", err)
+				} else {
+					c.printImportResult(result)
+					for _, name := range result.Imported {
+						if key := c.HttpServer.GetKey(name); key != nil {
+							servers.KeyChange(c.Operator, c.Session, "http", name, "import", "", auditState(key))
+						} else {
+							servers.KeyChange(c.Operator, c.Session, "dns", name, "import", "", auditState(c.DnsServer.GetKey(name)))
+						}
+					}
+					servers.SettingChanges(c.Operator, "http", "import", httpSettings, c.HttpServer.SettingValues())
+					servers.SettingChanges(c.Operator, "dns", "import", dnsSettings, c.DnsServer.SettingValues())
+					c.HttpServer.Changed()
+					c.DnsServer.Changed()
+				}
+			}
+		case "encrypt":
+			if len(words) < 4 || len(words) > 7 {
+				c.println("[!] Use `encrypt <keyname> <infile> <outfile> [hash] [kdf] [iterations]` to encrypt a payload with a key's hash")
+			} else {
+				c.encryptPayload(words[1:], c.HttpServer, c.DnsServer)
+			}
+		case "stager":
+			if len(words) < 3 || len(words) > 5 {
+				c.println("[!] Use `stager <keyname> <language> [outfile] [payloadurl]` to generate a stager for a key")
+			} else {
+				c.generateStager(words[1:], c.HttpServer, c.DnsServer)
+			}
 		case "time":
-			printCurrentTime()
+			c.printCurrentTime()
 		case "help":
-			menuItems.printHelp()
+			menuItems.printHelp(c.out())
 		case "exit":
 			c.MenuType = "Quit"
 			return
 		case "":
 			continue
 		default:
-			fmt.Println("[!] Invalid command!")
+			c.println("[!] Invalid command!")
 		}
 	}
 }
 
 func (c *CmdInfo) HttpMenu() {
 	menuItems := getHttpMenuItems(c.HttpServer)
-	c.TabCompleters[c.MenuType].Config.AutoComplete = menuItems.Completer
+	c.setCompleter(menuItems.Completer)
 
 	for {
-		line, err := c.TabCompleters[c.MenuType].Readline()
+		line, err := c.readLine()
 		if err == readline.ErrInterrupt {
 			if len(line) == 0 {
 				break
@@ -297,80 +424,51 @@ func (c *CmdInfo) HttpMenu() {
 
 		switch words[0] {
 		case "start":
-			startHttpServer(c.HttpServer)
+			c.startHttpServer(c.HttpServer)
 		case "stop":
-			stopHttpServer(c.HttpServer)
+			c.stopHttpServer(c.HttpServer)
 		case "restart":
-			stopHttpServer(c.HttpServer)
-			if !c.HttpServer.Running {
-				startHttpServer(c.HttpServer)
+			c.stopHttpServer(c.HttpServer)
+			if !c.HttpServer.IsRunning() {
+				c.startHttpServer(c.HttpServer)
 			}
 		case "info":
-			printHttpStatus(c.HttpServer)
+			c.printHttpStatus(c.HttpServer)
 		case "unset":
 			if len(words) == 2 {
-				setting := strings.ToLower(words[1])
-
-				found := false
-				for k, v := range c.HttpServer.State {
-					if strings.ToLower(k) == setting {
-						v.Value = v.Default
-						found = true
-					}
-				}
-				if !found {
-					fmt.Printf("[!] Server setting does not exist: " + words[1])
+				before := c.HttpServer.SettingValues()
+				if err := c.HttpServer.UnsetSetting(words[1]); err != nil {
+					c.printf("[!] %s\n", err)
+				} else {
+					servers.SettingChanges(c.Operator, "http", "unset", before, c.HttpServer.SettingValues())
+					c.HttpServer.Changed()
 				}
 			}
 		case "set":
-			if len(words) > 1 {
-				setting := strings.ToLower(words[1])
-				found := ""
-				for k := range c.HttpServer.State {
-					if strings.ToLower(k) == setting {
-						found = k
-						break
-					}
-				}
-				if found != "" {
-					errorMsg := fmt.Sprintf("[!] Invalid command, use 'help %s' for more info", found)
-					switch found {
-					case "CertPath", "KeyPath":
-						if len(words) > 2 {
-							filePath := strings.Join(words[2:], " ")
-							// Check if file actually exists
-							_, err := os.Stat(filePath)
-							if err == nil {
-								c.HttpServer.State[found].Value = filePath
-							} else {
-								fmt.Printf("[!] Error reading file: %s\n", err)
-							}
-						} else {
-							fmt.Println(errorMsg)
-						}
-					default:
-						// by default we will blindly set the value to word[2:] (everything after the second word on the line)
-						if len(words) > 2 {
-							c.HttpServer.State[found].Value = strings.Join(words[2:], " ")
-						} else {
-							fmt.Println(errorMsg)
-						}
-					}
+			if len(words) > 2 {
+				before := c.HttpServer.SettingValues()
+				if err := c.HttpServer.SetSetting(words[1], strings.Join(words[2:], " ")); err != nil {
+					c.printf("[!] %s\n", err)
+				} else {
+					servers.SettingChanges(c.Operator, "http", "set", before, c.HttpServer.SettingValues())
+					c.HttpServer.Changed()
 				}
+			} else {
+				c.println("[!] Invalid command, use `set <setting> <value>`")
 			}
 		case "help":
 			if len(words) != 2 {
-				fmt.Println()
-				menuItems.printHelp()
-				fmt.Println("Use help <setting> to learn more about each setting")
-				fmt.Println()
+				c.println()
+				menuItems.printHelp(c.out())
+				c.println("Use help <setting> to learn more about each setting")
+				c.println()
 			} else {
 				if _, ok := c.HttpServer.State[words[1]]; ok {
-					fmt.Println()
-					fmt.Println(c.HttpServer.State[words[1]].Help)
-					fmt.Println()
+					c.println()
+					c.println(c.HttpServer.State[words[1]].Help)
+					c.println()
 				} else {
-					fmt.Printf("[!] The DNS server setting %s does not exist!", words[1])
+					c.printf("[!] The DNS server setting %s does not exist!", words[1])
 				}
 			}
 		case "exit", "back":
@@ -379,17 +477,17 @@ func (c *CmdInfo) HttpMenu() {
 		case "":
 			continue
 		default:
-			fmt.Println("[!] Invalid command!")
+			c.println("[!] Invalid command!")
 		}
 	}
 }
 
 func (c *CmdInfo) DnsMenu() {
 	menuItems := getDnsMenuItems(c.DnsServer)
-	c.TabCompleters[c.MenuType].Config.AutoComplete = menuItems.Completer
+	c.setCompleter(menuItems.Completer)
 
 	for {
-		line, err := c.TabCompleters[c.MenuType].Readline()
+		line, err := c.readLine()
 		if err == readline.ErrInterrupt {
 			if len(line) == 0 {
 				break
@@ -404,80 +502,51 @@ func (c *CmdInfo) DnsMenu() {
 
 		switch words[0] {
 		case "start":
-			startDnsServer(c.DnsServer)
+			c.startDnsServer(c.DnsServer)
 		case "stop":
-			stopDnsServer(c.DnsServer)
+			c.stopDnsServer(c.DnsServer)
 		case "restart":
-			stopDnsServer(c.DnsServer)
-			if !c.DnsServer.Running {
-				startDnsServer(c.DnsServer)
+			c.stopDnsServer(c.DnsServer)
+			if !c.DnsServer.IsRunning() {
+				c.startDnsServer(c.DnsServer)
 			}
 		case "info":
-			printDnsStatus(c.DnsServer)
+			c.printDnsStatus(c.DnsServer)
 		case "unset":
 			if len(words) == 2 {
-				setting := strings.ToLower(words[1])
-
-				found := false
-				for k, v := range c.DnsServer.State {
-					if strings.ToLower(k) == setting {
-						v.Value = v.Default
-						found = true
-					}
-				}
-				if !found {
-					fmt.Printf("[!] Server setting does not exist: " + words[1])
+				before := c.DnsServer.SettingValues()
+				if err := c.DnsServer.UnsetSetting(words[1]); err != nil {
+					c.printf("[!] %s\n", err)
+				} else {
+					servers.SettingChanges(c.Operator, "dns", "unset", before, c.DnsServer.SettingValues())
+					c.DnsServer.Changed()
 				}
 			}
 		case "set":
-			if len(words) > 1 {
-				setting := strings.ToLower(words[1])
-				found := ""
-				for k := range c.DnsServer.State {
-					if strings.ToLower(k) == setting {
-						found = k
-						break
-					}
-				}
-				if found != "" {
-					errorMsg := fmt.Sprintf("[!] Invalid command, use 'help %s' for more info", found)
-					switch found {
-					case "DefaultTTL":
-						if len(words) == 3 {
-							// Update the DefaultTTL uint attribute
-							val, err := strconv.ParseUint(words[2], 10, 32)
-							if err != nil {
-								fmt.Printf("[!] %s is not a valid number\n", words[2])
-							} else {
-								c.DnsServer.DefaultTTL = uint(val)
-								c.DnsServer.State[found].Value = words[2]
-							}
-						} else {
-							fmt.Println(errorMsg)
-						}
-					default:
-						// by default we will blindly set the value to word[2:] (everything after the second word on the line)
-						if len(words) > 2 {
-							c.DnsServer.State[found].Value = strings.Join(words[2:], " ")
-						} else {
-							fmt.Println(errorMsg)
-						}
-					}
+			if len(words) > 2 {
+				before := c.DnsServer.SettingValues()
+				if err := c.DnsServer.SetSetting(words[1], strings.Join(words[2:], " ")); err != nil {
+					c.printf("[!] %s\n", err)
+				} else {
+					servers.SettingChanges(c.Operator, "dns", "set", before, c.DnsServer.SettingValues())
+					c.DnsServer.Changed()
 				}
+			} else {
+				c.println("[!] Invalid command, use `set <setting> <value>`")
 			}
 		case "help":
 			if len(words) != 2 {
-				fmt.Println()
-				menuItems.printHelp()
-				fmt.Println("Use help <setting> to learn more about each setting")
-				fmt.Println()
+				c.println()
+				menuItems.printHelp(c.out())
+				c.println("Use help <setting> to learn more about each setting")
+				c.println()
 			} else {
 				if _, ok := c.DnsServer.State[words[1]]; ok {
-					fmt.Println()
-					fmt.Println(c.DnsServer.State[words[1]].Help)
-					fmt.Println()
+					c.println()
+					c.println(c.DnsServer.State[words[1]].Help)
+					c.println()
 				} else {
-					fmt.Printf("[!] The DNS server setting %s does not exist!", words[1])
+					c.printf("[!] The DNS server setting %s does not exist!", words[1])
 				}
 			}
 		case "exit", "back":
@@ -486,29 +555,19 @@ func (c *CmdInfo) DnsMenu() {
 		case "":
 			continue
 		default:
-			fmt.Println("[!] Invalid command!")
+			c.println("[!] Invalid command!")
 		}
 	}
 }
 
 func (c *CmdInfo) HttpKeyMenu() {
-	keyName := "NewHttpKey"
-	key := &servers.Key{
-		Type:       "http",
-		Disabled:   false,
-		SendAlerts: false,
-		Data:       servers.HttpKeyData(),
-		Hashes:     make(map[string]string),
-		HitCounter: make(map[string]int),
-	}
-	key.HitCounter[servers.GetToday()] = 0
-	key.Constraints = key.GetHttpKeyConstraints()
+	keyName, key, editing := c.keyMenuKey("http", "NewHttpKey")
 
 	menuItems := getHttpKeyMenuItems(key)
-	c.TabCompleters[c.MenuType].Config.AutoComplete = menuItems.Completer
+	c.setCompleter(menuItems.Completer)
 
 	for {
-		line, err := c.TabCompleters[c.MenuType].Readline()
+		line, err := c.readLine()
 		if err == readline.ErrInterrupt {
 			if len(line) == 0 {
 				break
@@ -523,9 +582,9 @@ func (c *CmdInfo) HttpKeyMenu() {
 
 		switch words[0] {
 		case "info":
-			printKeyMenuStatus(key, keyName)
+			c.printKeyMenuStatus(key, keyName)
 		case "help":
-			menuItems.printHelp()
+			menuItems.printHelp(c.out())
 		case "unset":
 			if len(words) == 2 {
 				setting := strings.ToLower(words[1])
@@ -537,6 +596,10 @@ func (c *CmdInfo) HttpKeyMenu() {
 						found = true
 					}
 				}
+				if setting == "expression" {
+					key.SetExpression("")
+					found = true
+				}
 				if !found {
 					for k, v := range key.Constraints {
 						if strings.ToLower(k) == setting {
@@ -545,7 +608,7 @@ func (c *CmdInfo) HttpKeyMenu() {
 						}
 					}
 					if !found {
-						fmt.Printf("[!] Setting does not exist: " + words[1])
+						c.printf("[!] Setting does not exist: %s\n", words[1])
 					}
 				}
 			}
@@ -570,10 +633,15 @@ func (c *CmdInfo) HttpKeyMenu() {
 				if setting == "name" {
 					found = "name"
 				}
+				if setting == "expression" {
+					found = "expression"
+				}
 				if found != "" {
 					switch found {
 					case "name":
 						keyName = words[2]
+					case "expression":
+						c.setExpression(key, strings.Join(words[2:], " "))
 					default:
 						// by default we will blindly set the value to word[2:] (everything after the second word on the line)
 						if isConstraint {
@@ -584,17 +652,37 @@ func (c *CmdInfo) HttpKeyMenu() {
 					}
 				}
 			} else {
-				fmt.Println("[!] Invalid command, use `set <setting> <value`")
+				c.println("[!] Invalid command, use `set <setting> <value`")
 			}
 		case "done":
-			response := askForPermission("[>] Add this key? [y/N] ")
+			if editing != "" {
+				if c.confirm("[>] Save changes to this key? [y/N] ") {
+					before := auditState(c.HttpServer.GetKey(editing))
+					hashChanged, err := c.HttpServer.EditKey(editing, keyName, key)
+					if err == nil {
+						if keyName != editing {
+							servers.KeyChange(c.Operator, c.Session, "http", editing, "rename", editing, keyName)
+						}
+						servers.KeyChange(c.Operator, c.Session, "http", keyName, "edit", before, servers.AuditState(key))
+						c.HttpServer.Changed()
+						c.warnHashChanged(hashChanged)
+						c.MenuType = "Main"
+						return
+					}
+					c.printf("[!] Error saving key: %s\n", err)
+				}
+				continue
+			}
+			response := c.confirm("[>] Add this key? [y/N] ")
 			if response {
 				err := c.HttpServer.AddKey(key, keyName)
 				if err == nil {
+					servers.KeyChange(c.Operator, c.Session, "http", keyName, "add", "", servers.AuditState(key))
+					c.HttpServer.Changed()
 					c.MenuType = "Main"
 					return
 				}
-				fmt.Printf("[!] Error adding key: %s\n", err)
+				c.printf("[!] Error adding key: %s\n", err)
 			}
 		case "exit", "back":
 			c.MenuType = "Main"
@@ -602,29 +690,19 @@ func (c *CmdInfo) HttpKeyMenu() {
 		case "":
 			continue
 		default:
-			fmt.Println("[!] Invalid command!")
+			c.println("[!] Invalid command!")
 		}
 	}
 }
 
 func (c *CmdInfo) DnsKeyMenu() {
-	keyName := "NewDnsKey"
-	key := &servers.Key{
-		Type:       "dns",
-		Disabled:   false,
-		SendAlerts: false,
-		Data:       servers.DnsKeyData(),
-		Hashes:     make(map[string]string),
-		HitCounter: make(map[string]int),
-	}
-	key.HitCounter[servers.GetToday()] = 0
-	key.Constraints = key.GetDnsKeyConstraints()
+	keyName, key, editing := c.keyMenuKey("dns", "NewDnsKey")
 
 	menuItems := getDnsKeyMenuItems(key)
-	c.TabCompleters[c.MenuType].Config.AutoComplete = menuItems.Completer
+	c.setCompleter(menuItems.Completer)
 
 	for {
-		line, err := c.TabCompleters[c.MenuType].Readline()
+		line, err := c.readLine()
 		if err == readline.ErrInterrupt {
 			if len(line) == 0 {
 				break
@@ -639,9 +717,9 @@ func (c *CmdInfo) DnsKeyMenu() {
 
 		switch words[0] {
 		case "info":
-			printKeyMenuStatus(key, keyName)
+			c.printKeyMenuStatus(key, keyName)
 		case "help":
-			menuItems.printHelp()
+			menuItems.printHelp(c.out())
 		case "unset":
 			if len(words) == 2 {
 				setting := strings.ToLower(words[1])
@@ -653,6 +731,10 @@ func (c *CmdInfo) DnsKeyMenu() {
 						found = true
 					}
 				}
+				if setting == "expression" {
+					key.SetExpression("")
+					found = true
+				}
 				if !found {
 					for k, v := range key.Constraints {
 						if strings.ToLower(k) == setting {
@@ -661,7 +743,7 @@ func (c *CmdInfo) DnsKeyMenu() {
 						}
 					}
 					if !found {
-						fmt.Printf("[!] Setting does not exist: " + words[1])
+						c.printf("[!] Setting does not exist: %s\n", words[1])
 					}
 				}
 			}
@@ -686,10 +768,15 @@ func (c *CmdInfo) DnsKeyMenu() {
 				if setting == "name" {
 					found = "name"
 				}
+				if setting == "expression" {
+					found = "expression"
+				}
 				if found != "" {
 					switch found {
 					case "name":
 						keyName = words[2]
+					case "expression":
+						c.setExpression(key, strings.Join(words[2:], " "))
 					default:
 						// by default we will blindly set the value to word[2:] (everything after the second word on the line)
 						if isConstraint {
@@ -700,17 +787,37 @@ func (c *CmdInfo) DnsKeyMenu() {
 					}
 				}
 			} else {
-				fmt.Println("[!] Invalid command, use `set <setting> <value`")
+				c.println("[!] Invalid command, use `set <setting> <value`")
 			}
 		case "done":
-			response := askForPermission("[>] Add this key? [y/N] ")
+			if editing != "" {
+				if c.confirm("[>] Save changes to this key? [y/N] ") {
+					before := auditState(c.DnsServer.GetKey(editing))
+					hashChanged, err := c.DnsServer.EditKey(editing, keyName, key)
+					if err == nil {
+						if keyName != editing {
+							servers.KeyChange(c.Operator, c.Session, "dns", editing, "rename", editing, keyName)
+						}
+						servers.KeyChange(c.Operator, c.Session, "dns", keyName, "edit", before, servers.AuditState(key))
+						c.DnsServer.Changed()
+						c.warnHashChanged(hashChanged)
+						c.MenuType = "Main"
+						return
+					}
+					c.printf("[!] Error saving key: %s\n", err)
+				}
+				continue
+			}
+			response := c.confirm("[>] Add this key? [y/N] ")
 			if response {
 				err := c.DnsServer.AddKey(key, keyName)
 				if err == nil {
+					servers.KeyChange(c.Operator, c.Session, "dns", keyName, "add", "", servers.AuditState(key))
+					c.DnsServer.Changed()
 					c.MenuType = "Main"
 					return
 				}
-				fmt.Printf("[!] Error adding key: %s\n", err)
+				c.printf("[!] Error adding key: %s\n", err)
 			}
 		case "exit", "back":
 			c.MenuType = "Main"
@@ -718,192 +825,250 @@ func (c *CmdInfo) DnsKeyMenu() {
 		case "":
 			continue
 		default:
-			fmt.Println("[!] Invalid command!")
+			c.println("[!] Invalid command!")
 		}
 	}
 }
 
-func startHttpServer(h *servers.HttpServer) {
-	if h.Running {
-		fmt.Println("[!] HTTP server already running, use 'restart'")
+func (c *CmdInfo) startHttpServer(h *servers.HttpServer) {
+	if h.IsRunning() {
+		c.println("[!] HTTP server already running, use 'restart'")
 		return
 	}
-	if h.State["CertPath"].Value != "" && h.State["KeyPath"].Value != "" {
-		h.StartHTTPS()
-	} else {
-		h.StartHTTP()
-	}
-	time.Sleep(1 * time.Second)
-	if !h.Running {
-		fmt.Println("[!] Error occurred starting the HTTP server, port already in use?")
+	if err := h.Start(); err != nil {
+		c.printf("[!] %s\n", err)
 	} else {
-		fmt.Println("[+] HTTP server successfully started!")
+		servers.ServerChange(c.Operator, "http", "start")
+		c.println("[+] HTTP server successfully started!")
 	}
 }
 
-func stopHttpServer(h *servers.HttpServer) {
-	if !h.Running {
-		fmt.Printf("[!] HTTP server isn't running\n")
+func (c *CmdInfo) stopHttpServer(h *servers.HttpServer) {
+	if !h.IsRunning() {
+		c.printf("[!] HTTP server isn't running\n")
 		return
 	}
-	err := h.Server.Shutdown(nil)
+	err := h.Stop()
 	if err != nil {
-		fmt.Printf("[!] Error shutting down HTTP gracefully: %s\n", err)
+		c.printf("[!] Error shutting down HTTP gracefully: %s\n", err)
 		return
 	}
+	servers.ServerChange(c.Operator, "http", "stop")
 	time.Sleep(1 * time.Second)
-	fmt.Println("[*] HTTP server stopped")
-	h.Running = false
+	c.println("[*] HTTP server stopped")
 }
 
-func printHttpStatus(h *servers.HttpServer) {
-	fmt.Println()
-	fmt.Println("HTTP Key Server")
-	fmt.Printf("Running: %s\n", isRunning(h.Running))
+func (c *CmdInfo) printHttpStatus(h *servers.HttpServer) {
+	c.println()
+	c.println("HTTP Key Server")
+	c.printf("Running: %s\n", isRunning(h.IsRunning()))
 
 	// Print modifiable settings
-	settings := servers.AlphabetizeSettings(h.State)
-	for _, name := range settings {
-		fmt.Printf("    %s %s\n", columnString(name+returnAsterisk(h.State[name].Required)), h.State[name].Value)
+	settings := h.Settings()
+	for _, name := range servers.AlphabetizeSettings(settings) {
+		c.printf("    %s %s\n", columnString(name+returnAsterisk(settings[name].Required)), settings[name].Value)
 	}
-	fmt.Println()
+	c.println()
 }
 
-func startDnsServer(d *servers.DnsServer) {
-	if d.Running {
-		fmt.Println("[!] DNS server already running, use 'restart'")
+func (c *CmdInfo) startDnsServer(d *servers.DnsServer) {
+	if d.IsRunning() {
+		c.println("[!] DNS server already running, use 'restart'")
 		return
 	}
-	d.StartDNS()
-	time.Sleep(1 * time.Second)
-	if !d.Running {
-		fmt.Println("[!] Error occurred starting the DNS server, port already in use?")
+	if d.Setting("Domain") == "" {
+		c.println("[!] Set the Domain the DNS server is authoritative for first, use 'config dns'")
+		return
+	}
+	if err := d.Start(); err != nil {
+		c.printf("[!] %s\n", err)
 	} else {
-		fmt.Println("[+] DNS server successfully started!")
+		servers.ServerChange(c.Operator, "dns", "start")
+		c.println("[+] DNS server successfully started!")
 	}
 }
 
-func stopDnsServer(d *servers.DnsServer) {
-	if !d.Running {
-		fmt.Println("[!] DNS server isn't running")
+func (c *CmdInfo) stopDnsServer(d *servers.DnsServer) {
+	if !d.IsRunning() {
+		c.println("[!] DNS server isn't running")
 		return
 	}
-	err := d.Server.Shutdown()
+	err := d.Stop()
 	if err != nil {
-		fmt.Printf("[!] Error shutting down DNS gracefully: %s\n", err)
+		c.printf("[!] Error shutting down DNS gracefully: %s\n", err)
 		return
 	}
+	servers.ServerChange(c.Operator, "dns", "stop")
 	time.Sleep(1 * time.Second)
-	fmt.Println("[*] DNS server stopped")
-	d.Running = false
+	c.println("[*] DNS server stopped")
 }
 
-func printDnsStatus(d *servers.DnsServer) {
-	fmt.Println()
-	fmt.Println("DNS Key Server")
-	fmt.Printf("Running: %s\n", isRunning(d.Running))
+func (c *CmdInfo) printDnsStatus(d *servers.DnsServer) {
+	c.println()
+	c.println("DNS Key Server")
+	c.printf("Running: %s\n", isRunning(d.IsRunning()))
 
 	// Print modifiable settings
-	settings := servers.AlphabetizeSettings(d.State)
-	for _, name := range settings {
-		fmt.Printf("    %s %s\n", columnString(name+returnAsterisk(d.State[name].Required)), columnString(d.State[name].Value))
+	settings := d.Settings()
+	for _, name := range servers.AlphabetizeSettings(settings) {
+		c.printf("    %s %s\n", columnString(name+returnAsterisk(settings[name].Required)), columnString(settings[name].Value))
 	}
-	fmt.Println()
+	c.println()
 }
 
 // Prints status of menu items when selecting Key attributes
-func printKeyMenuStatus(k *servers.Key, name string) {
-	fmt.Println()
-	fmt.Println("Key: ")
-	fmt.Printf("    %s '%s'\n", columnString("Name:"), name)
+func (c *CmdInfo) printKeyMenuStatus(k *servers.Key, name string) {
+	c.println()
+	c.println("Key: ")
+	c.printf("    %s '%s'\n", columnString("Name:"), name)
 
 	keyData := servers.AlphabetizeKeyData(k.Data)
 	for _, name := range keyData {
-		fmt.Printf("    %s '%s'\n", columnString(name+":"), k.Data[name].Value)
-		fmt.Printf("        %s\n", k.Data[name].Description)
+		c.printf("    %s '%s'\n", columnString(name+":"), k.Data[name].Value)
+		c.printf("        %s\n", k.Data[name].Description)
 	}
-	fmt.Println("\nConstraints:")
+	c.println("\nConstraints:")
 	constraints := servers.AlphabetizeConstraints(k.Constraints)
 	for _, name := range constraints {
-		fmt.Printf("    %s '%s'\n", columnString(name+":"), k.Constraints[name].Constraint)
-		fmt.Printf("        %s\n", k.Constraints[name].Description)
+		c.printf("    %s '%s'\n", columnString(name+":"), k.Constraints[name].Constraint)
+		c.printf("        %s\n", k.Constraints[name].Description)
+	}
+	c.printf("    %s '%s'\n", columnString("Expression:"), k.Expression)
+	c.println("        Combine constraints with &&, ||, ! and (), e.g. (Time && UserAgent) || Manual")
+	c.println("        If empty, any constraint turns the key on while HitLimit turns it off")
+	c.println()
+}
+
+// setExpression sets a key's constraint expression, pointing out where the
+// expression went wrong if it can't be parsed
+func (c *CmdInfo) setExpression(k *servers.Key, expr string) {
+	err := k.SetExpression(expr)
+	if err == nil {
+		return
+	}
+	c.printf("[!] %s\n", err)
+	if exprErr, ok := err.(*servers.ExpressionError); ok {
+		c.println(exprErr.Pointer())
 	}
-	fmt.Println()
 }
 
 // printKey shows more detail for one specific key by name
-func printKey(key *servers.Key, name string) {
-	fmt.Println()
-	fmt.Printf("Name: %s (%s)\n", name, key.Type)
+func (c *CmdInfo) printKey(key *servers.Key, name string) {
+	c.println()
+	c.printf("Name: %s (%s)\n", name, key.Type)
 
 	if key.Type == "dns" {
-		fmt.Printf("Hostname: %s\n", key.Data["Hostname"].Value)
-		fmt.Printf("Record Type: %s\n", key.Data["RecordType"].Value)
-		fmt.Printf("Response: %s\n", key.Data["Response"].Value)
-		fmt.Printf("TTL: %s\n", key.Data["TTL"].Value)
+		c.printf("Hostname: %s\n", key.Data["Hostname"].Value)
+		if key.Data["HostnameMatch"].Value != "exact" {
+			c.printf("Hostname Match: %s\n", key.Data["HostnameMatch"].Value)
+		}
+		c.printf("Record Type: %s\n", key.Data["RecordType"].Value)
+		c.printf("Response: %s\n", key.Data["Response"].Value)
+		if key.Data["RecordType"].Value == "TXT" {
+			c.printf("TXT Split: %s\n", key.Data["TXTSplit"].Value)
+		}
+		c.printf("TTL: %s\n", key.Data["TTL"].Value)
 	} else if key.Type == "http" {
-		fmt.Printf("URL: %s\n", key.Data["URL"].Value)
-		fmt.Printf("FilePath: %s\n", key.Data["FilePath"].Value)
+		c.printf("URL: %s\n", key.Data["URL"].Value)
+		c.printf("FilePath: %s\n", key.Data["FilePath"].Value)
+		c.printf("Drift Policy: %s\n", key.Data["DriftPolicy"].Value)
+		if key.Data["KeySelector"].Value != "" {
+			c.printf("Key Selector: %s\n", key.Data["KeySelector"].Value)
+			material := key.GetMaterial()
+			c.printf("Key Material (%d bytes): '%s'\n", len(material), material)
+		}
 	} else {
-		fmt.Printf("[!] Unknown key type: %s\n", key.Type)
+		c.printf("[!] Unknown key type: %s\n", key.Type)
 		return
 	}
 
-	fmt.Println()
-	fmt.Println("Hashes of response:")
-	for k, v := range key.Hashes {
-		fmt.Printf("%s: '%s'\n", k, v)
+	c.println()
+	c.println("Hashes of key material:")
+	hashes := key.GetHashes()
+	algs := make([]string, 0, len(hashes))
+	for alg := range hashes {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	for _, alg := range algs {
+		c.printf("%s: '%s'\n", alg, hashes[alg])
+	}
+	if key.Data["HmacSecret"].Value != "" {
+		c.println("(hmac-sha256 is keyed with the key's HmacSecret)")
 	}
 
-	fmt.Println()
+	c.println()
 	constraints := servers.AlphabetizeConstraints(key.Constraints)
-	fmt.Println("Constraints:")
+	c.println("Constraints:")
 	for _, name := range constraints {
-		fmt.Printf("    %s '%s'\n", columnString(name), key.Constraints[name].Constraint)
+		c.printf("    %s '%s'\n", columnString(name), key.Constraints[name].Constraint)
+	}
+	if key.Expression != "" {
+		c.printf("    %s '%s'\n", columnString("Expression"), key.Expression)
 	}
-	fmt.Println()
+	c.println()
 }
 
-func printKeys(keys map[string]*servers.Key) {
+func (c *CmdInfo) printKeys(keys map[string]*servers.Key) {
 	if len(keys) == 0 {
 		return
 	}
-	fmt.Println()
-	fmt.Println("Keys ---")
+	c.println()
+	c.println("Keys ---")
 	for name, key := range keys {
-		fmt.Printf("    Name: %s\n", name)
+		c.printf("    Name: %s\n", name)
 
 		if key.Type == "dns" {
-			fmt.Printf("    Hostname: %s\n", key.Data["Hostname"].Value)
+			c.printf("    Hostname: %s\n", key.Data["Hostname"].Value)
 		} else if key.Type == "http" {
-			fmt.Printf("    URL: %s\n", key.Data["URL"].Value)
+			c.printf("    URL: %s\n", key.Data["URL"].Value)
 		} else {
-			fmt.Printf("[!] Unknown key type: %s\n", key.Type)
+			c.printf("[!] Unknown key type: %s\n", key.Type)
 			continue
 		}
-		fmt.Printf("    Hits Today: %d\n", key.GetHits())
-		fmt.Printf("    Last Hit: %s\n", key.LastHit)
-		if key.SendAlerts {
-			fmt.Println("    Alerts: Enabled")
+		c.printf("    Hits Today: %d\n", key.GetHits())
+		c.printf("    Last Hit: %s\n", key.LastHit())
+		if key.AlertsEnabled() {
+			c.println("    Alerts: Enabled")
 		} else {
-			fmt.Println("    Alerts: Disabled")
+			c.println("    Alerts: Disabled")
 		}
 
-		active, reason := key.IsActive(nil, nil)
-		if active {
-			fmt.Printf("    Active: YES (%s)\n", reason)
-		} else {
+		status, reason := key.Status()
+		switch status {
+		case servers.StatusActive:
+			c.printf("    Active: YES (%s)\n", reason)
+		case servers.StatusDepends:
+			c.printf("    Active: DEPENDS ON REQUEST (%s)\n", reason)
+		default:
 			if reason != "" {
 				reason = "(" + reason + ")"
 			}
-			fmt.Printf("    Active: NO %s\n", reason)
+			c.printf("    Active: NO %s\n", reason)
 		}
-		fmt.Println()
+		c.println()
+	}
+}
+
+// printImportResult summarizes which keys were imported and any that need attention
+func (c *CmdInfo) printImportResult(result *servers.ImportResult) {
+	c.printf("[*] Imported %d keys\n", len(result.Imported))
+	for _, name := range result.Conflicts {
+		c.printf("[!] Key name already exists, skipped: %s\n", name)
+	}
+	for _, msg := range result.Failed {
+		c.printf("[!] Error adding key %s\n", msg)
+	}
+	for _, msg := range result.Settings {
+		c.printf("[!] Error importing setting %s\n", msg)
+	}
+	for _, name := range result.Mismatch {
+		c.printf("[!] Hash no longer matches the key's content, payloads may need rebuilding: %s\n", name)
 	}
 }
 
-func printCurrentTime() {
-	fmt.Println(time.Now().Format("Jan 2 15:04"))
+func (c *CmdInfo) printCurrentTime() {
+	c.println(time.Now().Format("Jan 2 15:04"))
 }
 
 func isRunning(result bool) string {
@@ -920,10 +1085,19 @@ func returnAsterisk(result bool) string {
 	return ": "
 }
 
-func askForPermission(q string) bool {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print(q)
-	confirm, err := reader.ReadString('\n')
+// askForPermission asks a yes/no question at the current menu's prompt so it
+// works for team server sessions as well as the local console
+func (c *CmdInfo) askForPermission(q string) bool {
+	if c.TabCompleters == nil {
+		return false
+	}
+	inst := c.TabCompleters[c.MenuType]
+	inst.SetPrompt(q)
+	inst.HistoryDisable()
+	confirm, err := inst.Readline()
+	inst.HistoryEnable()
+	inst.SetPrompt(menuPrompts[c.MenuType])
+
 	confirm = strings.TrimSpace(confirm)
 	if confirm == "n" || confirm == "N" || err != nil {
 		return false
@@ -931,22 +1105,144 @@ func askForPermission(q string) bool {
 	return true
 }
 
-// searches by name for a http or dns key, returns (httpKeyName, dnsKeyName), each string is empty if not found
-func findKey(input string, httpKeys map[string]*servers.Key, dnsKeys map[string]*servers.Key) (string, string) {
-	var dnsKeyName string
-	var httpKeyName string
-	setting := strings.ToLower(input)
-
-	for k := range httpKeys {
-		if strings.ToLower(k) == setting {
-			httpKeyName = k
+// encryptPayload handles the encrypt command, args are keyname, infile,
+// outfile and optionally hash, kdf and iterations
+func (c *CmdInfo) encryptPayload(args []string, h *servers.HttpServer, d *servers.DnsServer) {
+	var key *servers.Key
+	httpKeyFound, dnsKeyFound := findKey(args[0], h, d)
+	if httpKeyFound != "" {
+		key = h.GetKey(httpKeyFound)
+	} else if dnsKeyFound != "" {
+		key = d.GetKey(dnsKeyFound)
+	}
+	if key == nil {
+		c.printf("[!] No key named %s\n", args[0])
+		return
+	}
+
+	opts := servers.EncryptOptions{}
+	if len(args) > 3 {
+		opts.Hash = args[3]
+	}
+	if len(args) > 4 {
+		opts.KDF = args[4]
+	}
+	if len(args) > 5 {
+		iterations, err := strconv.Atoi(args[5])
+		if err != nil || iterations < 1 {
+			c.println("[!] Iterations must be a number greater than 0")
+			return
 		}
+		opts.Iterations = iterations
+	}
+
+	header, err := servers.EncryptFile(key, args[1], args[2], opts)
+	if err != nil {
+		c.printf("[!] Error encrypting %s: %s\n", args[1], err)
+		return
 	}
-	for k := range dnsKeys {
-		if strings.ToLower(k) == setting {
-			dnsKeyName = k
+	c.printf("[+] Encrypted %s to %s\n", args[1], args[2])
+	c.printf("[*] %s key from the %s hash via %s (%d iterations)\n", header.Algorithm, header.Hash, header.KDF, header.Iterations)
+}
+
+// generateStager handles the stager command, args are keyname, language and
+// optionally an outfile and payload URL. Without an outfile the source is printed.
+func (c *CmdInfo) generateStager(args []string, h *servers.HttpServer, d *servers.DnsServer) {
+	var key *servers.Key
+	httpKeyFound, dnsKeyFound := findKey(args[0], h, d)
+	if httpKeyFound != "" {
+		key = h.GetKey(httpKeyFound)
+	} else if dnsKeyFound != "" {
+		key = d.GetKey(dnsKeyFound)
+	}
+	if key == nil {
+		c.printf("[!] No key named %s\n", args[0])
+		return
+	}
+	name := httpKeyFound
+	if name == "" {
+		name = dnsKeyFound
+	}
+
+	opts := stager.Options{}
+	if len(args) > 3 {
+		opts.PayloadURL = args[3]
+	}
+	source, hash, err := stager.Generate(name, key, h, d, strings.ToLower(args[1]), opts)
+	if err != nil {
+		c.printf("[!] Error generating stager: %s\n", err)
+		return
+	}
+
+	if len(args) > 2 {
+		if err := ioutil.WriteFile(args[2], []byte(source), 0644); err != nil {
+			c.printf("[!] Error writing stager: %s\n", err)
+			return
 		}
+		c.printf("[+] Wrote %s stager to %s\n", args[1], args[2])
+	} else {
+		c.println(source)
 	}
+	c.printf("[*] Stager uses the %s hash, encrypt payloads with `encrypt %s <infile> <outfile> %s`\n", hash, name, hash)
+	if strings.Contains(source, stager.Placeholder) {
+		c.printf("[*] Replace %s with the server's public address or payload URL before using\n", stager.Placeholder)
+	}
+}
+
+// keyMenuKey returns the name and key a key menu starts with, a copy of the
+// key being edited if there is one otherwise a new key. The name of the key
+// being edited is returned, empty for a new key.
+func (c *CmdInfo) keyMenuKey(keyType, newName string) (string, *servers.Key, string) {
+	editing := c.EditKey
+	c.EditKey = ""
 
-	return httpKeyName, dnsKeyName
+	var existing *servers.Key
+	if keyType == "http" {
+		existing = c.HttpServer.GetKey(editing)
+	} else {
+		existing = c.DnsServer.GetKey(editing)
+	}
+	if editing == "" || existing == nil {
+		return newName, servers.NewKey(keyType), ""
+	}
+	c.printf("[*] Editing %s, use 'done' to save changes or 'back' to discard them\n", editing)
+	return editing, existing.Copy(), editing
+}
+
+// warnHashChanged tells the operator when editing a key changed its hash
+func (c *CmdInfo) warnHashChanged(changed bool) {
+	if changed {
+		c.println("[!] WARNING: The key's hash changed, payloads encrypted with the old hash will no longer decrypt!")
+	} else {
+		c.println("[+] Key saved, its hash is unchanged")
+	}
+}
+
+// changeKey makes an operator's change to a key found with findKey and
+// records it, state is the part of the key the change affects. Another
+// operator may have removed the key since it was found, in which case nothing
+// changes and false is returned.
+func (c *CmdInfo) changeKey(keyType, name, action string, key *servers.Key, state func(*servers.Key) string, change func(*servers.Key)) bool {
+	if key == nil {
+		c.printf("[!] Key %s has been removed\n", name)
+		return false
+	}
+	before := state(key)
+	change(key)
+	servers.KeyChange(c.Operator, c.Session, keyType, name, action, before, state(key))
+	return true
+}
+
+// auditState is servers.AuditState for a key that may have been removed
+// since it was found
+func auditState(key *servers.Key) string {
+	if key == nil {
+		return ""
+	}
+	return servers.AuditState(key)
+}
+
+// searches by name for a http or dns key, returns (httpKeyName, dnsKeyName), each string is empty if not found
+func findKey(input string, h *servers.HttpServer, d *servers.DnsServer) (string, string) {
+	return h.FindKey(input), d.FindKey(input)
 }
@@ -5,12 +5,14 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"sort"
 	"strings"
 
 	"github.com/chzyer/readline"
 	"github.com/leoloobeek/keyserver/servers"
+	"github.com/leoloobeek/keyserver/stager"
 )
 
 // MenuItems holds all commands for a menu
@@ -37,74 +39,35 @@ func filterInput(r rune) (rune, bool) {
 	return r, true
 }
 
+// InitializeCompleters sets up a prompt for each menu on the local terminal
 func InitializeCompleters() map[string]*readline.Instance {
+	return newCompleters(func(*readline.Config) {})
+}
+
+// newCompleters creates a readline instance for each menu, setup adjusts
+// each config before its instance is created
+func newCompleters(setup func(*readline.Config)) map[string]*readline.Instance {
 	// initialize tab completers
+	completers := make(map[string]*readline.Instance)
+	for _, menu := range []string{"Main", "Http", "Dns", "HttpKey", "DnsKey"} {
+		cfg := &readline.Config{
+			Prompt:          menuPrompts[menu],
+			AutoComplete:    nil,
+			InterruptPrompt: "^C",
+			EOFPrompt:       "exit",
+
+			HistorySearchFold:   true,
+			FuncFilterInputRune: filterInput,
+		}
+		setup(cfg)
 
-	// MainMenu
-	mmInst, err := readline.NewEx(&readline.Config{
-		Prompt:          "keyserver > ",
-		AutoComplete:    nil,
-		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
-
-		HistorySearchFold:   true,
-		FuncFilterInputRune: filterInput,
-	})
-
-	// HttpMenu
-	hmInst, err := readline.NewEx(&readline.Config{
-		Prompt:          "keyserver (http) > ",
-		AutoComplete:    nil,
-		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
-
-		HistorySearchFold:   true,
-		FuncFilterInputRune: filterInput,
-	})
-	// DnsMenu
-	dmInst, err := readline.NewEx(&readline.Config{
-		Prompt:          "keyserver (dns) > ",
-		AutoComplete:    nil,
-		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
-
-		HistorySearchFold:   true,
-		FuncFilterInputRune: filterInput,
-	})
-
-	// HttpKeyMenu
-	hkmInst, err := readline.NewEx(&readline.Config{
-		Prompt:          "keyserver (httpkey) > ",
-		AutoComplete:    nil,
-		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
-
-		HistorySearchFold:   true,
-		FuncFilterInputRune: filterInput,
-	})
-
-	// DnsKeyMenu
-	dkmInst, err := readline.NewEx(&readline.Config{
-		Prompt:          "keyserver (dnskey) > ",
-		AutoComplete:    nil,
-		InterruptPrompt: "^C",
-		EOFPrompt:       "exit",
-
-		HistorySearchFold:   true,
-		FuncFilterInputRune: filterInput,
-	})
-
-	if err != nil {
-		panic(err)
-	}
-
-	return map[string]*readline.Instance{
-		"Main":    mmInst,
-		"Http":    hmInst,
-		"Dns":     dmInst,
-		"HttpKey": hkmInst,
-		"DnsKey":  dkmInst,
+		inst, err := readline.NewEx(cfg)
+		if err != nil {
+			panic(err)
+		}
+		completers[menu] = inst
 	}
+	return completers
 }
 
 func (c *CmdInfo) getMainMenuItems() *MenuItems {
@@ -156,6 +119,27 @@ func (c *CmdInfo) getMainMenuItems() *MenuItems {
 		),
 	}
 
+	items["edit"] = &MenuItem{
+		Help:      "Edit an existing key, keeping its hit history",
+		Example:   "edit <keyname>",
+		Completer: readline.NewPrefixCompleter(readline.PcItemDynamic(c.getAllKeys())),
+	}
+
+	items["clone"] = &MenuItem{
+		Help:      "Copy a key to a new key with a different name, without its hit history",
+		Example:   "clone <src> <dst>",
+		Completer: readline.NewPrefixCompleter(readline.PcItemDynamic(c.getAllKeys())),
+	}
+
+	items["audit"] = &MenuItem{
+		Help:    "Show the audit log, for a key with when it was turned on, or check it hasn't been tampered with",
+		Example: "audit [keyname|verify [hash]]",
+		Completer: readline.NewPrefixCompleter(
+			readline.PcItem("verify"),
+			readline.PcItemDynamic(c.getAllKeys()),
+		),
+	}
+
 	items["status"] = &MenuItem{
 		Help:      "Show status of servers and keys",
 		Example:   "status",
@@ -210,6 +194,42 @@ func (c *CmdInfo) getMainMenuItems() *MenuItems {
 		Completer: readline.NewPrefixCompleter(readline.PcItemDynamic(c.getAllKeys())),
 	}
 
+	items["export"] = &MenuItem{
+		Help:      "Export all keys and server settings to a JSON or YAML file, the file includes HMAC secrets and pinned content",
+		Example:   "export engagement.yaml",
+		Completer: readline.NewPrefixCompleter(readline.PcItemDynamic(listFiles())),
+	}
+
+	items["import"] = &MenuItem{
+		Help:      "Import keys and server settings from a JSON or YAML file, listener settings can't change while a server is running",
+		Example:   "import engagement.yaml",
+		Completer: readline.NewPrefixCompleter(readline.PcItemDynamic(listFiles())),
+	}
+
+	items["encrypt"] = &MenuItem{
+		Help:    "Encrypt a payload with AES-GCM using a key derived from a key's hash",
+		Example: "encrypt <keyname> payload.bin payload.enc [sha512] [pbkdf2-sha256] [100000]",
+		Completer: readline.NewPrefixCompleter(
+			readline.PcItemDynamic(c.getAllKeys(),
+				readline.PcItemDynamic(listFiles(),
+					readline.PcItemDynamic(listFiles()),
+				),
+			),
+		),
+	}
+
+	items["stager"] = &MenuItem{
+		Help:    "Generate stager source that fetches a key and decrypts a payload with its hash",
+		Example: "stager <keyname> powershell stager.ps1 https://example.com/payload.enc",
+		Completer: readline.NewPrefixCompleter(
+			readline.PcItemDynamic(c.getAllKeys(),
+				readline.PcItemDynamic(getStagerLanguages(),
+					readline.PcItemDynamic(listFiles()),
+				),
+			),
+		),
+	}
+
 	items["time"] = &MenuItem{
 		Help:      "Display current time on keyserver (useful when setting time constraints)",
 		Example:   "time",
@@ -407,7 +427,7 @@ func listFiles() func(string) []string {
 
 func getSettingsAndConstraints(k *servers.Key) func(string) []string {
 	return func(line string) []string {
-		result := []string{"Name"}
+		result := []string{"Name", "Expression"}
 		for name, _ := range k.Data {
 			result = append(result, name)
 		}
@@ -418,13 +438,19 @@ func getSettingsAndConstraints(k *servers.Key) func(string) []string {
 	}
 }
 
+func getStagerLanguages() func(string) []string {
+	return func(line string) []string {
+		return stager.Languages()
+	}
+}
+
 func (c *CmdInfo) getAllKeys() func(string) []string {
 	return func(line string) []string {
 		var result []string
-		for name, _ := range c.HttpServer.Keys {
+		for name, _ := range c.HttpServer.Keys() {
 			result = append(result, name)
 		}
-		for name, _ := range c.DnsServer.Keys {
+		for name, _ := range c.DnsServer.Keys() {
 			result = append(result, name)
 		}
 		return result
@@ -465,7 +491,7 @@ func defaultItems() map[string]*MenuItem {
 	return items
 }
 
-func (mis *MenuItems) printHelp() {
+func (mis *MenuItems) printHelp(w io.Writer) {
 	// Get map into alphabetical order
 	keys := make([]string, len(mis.Items))
 	i := 0
@@ -477,9 +503,9 @@ func (mis *MenuItems) printHelp() {
 	sort.Strings(keys)
 
 	// Print out
-	fmt.Println("Commands:")
+	fmt.Fprintln(w, "Commands:")
 	for _, key := range keys {
-		fmt.Printf("\t%s%s\n", columnString(key), mis.Items[key].Help)
+		fmt.Fprintf(w, "\t%s%s\n", columnString(key), mis.Items[key].Help)
 	}
 }
 
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+const (
+	// maxMessageSize limits a single message from a remote console, they're
+	// only keystrokes and terminal reports
+	maxMessageSize = 64 * 1024
+
+	// writeTimeout stops a stalled remote console from holding up anything
+	// writing to it
+	writeTimeout = 10 * time.Second
+)
+
+// remoteTerminal is the server side of readline's remote protocol, which
+// keyserver-client speaks through readline.RemoteCli. readline has its own
+// RemoteSvr but it blocks forever once the connection drops, so this ends in
+// io.EOF instead and gives up on writes to a dead connection.
+type remoteTerminal struct {
+	conn       net.Conn
+	buf        *bufio.Reader
+	input      *io.PipeReader
+	inputW     *io.PipeWriter
+	writeMu    sync.Mutex
+	width      int32
+	isTerminal int32
+	onWidth    atomic.Value // func(), from readline
+	closeOnce  sync.Once
+}
+
+// newRemoteTerminal reads the terminal reports the client sends first
+func newRemoteTerminal(conn net.Conn) (*remoteTerminal, error) {
+	t := &remoteTerminal{conn: conn, buf: bufio.NewReader(conn)}
+	for _, want := range []readline.MsgType{readline.T_ISTTY_REPORT, readline.T_WIDTH_REPORT} {
+		m, err := t.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if m.Type != want {
+			return nil, errors.New("Unexpected message from the client")
+		}
+		t.handle(m)
+	}
+	t.input, t.inputW = io.Pipe()
+	go t.readLoop()
+	return t, nil
+}
+
+func (t *remoteTerminal) readMessage() (*readline.Message, error) {
+	var length int32
+	if err := binary.Read(t.buf, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 2 || length > maxMessageSize {
+		return nil, errors.New("Invalid message length from the client")
+	}
+	m := &readline.Message{}
+	if err := binary.Read(t.buf, binary.BigEndian, &m.Type); err != nil {
+		return nil, err
+	}
+	m.Data = make([]byte, length-2)
+	if _, err := io.ReadFull(t.buf, m.Data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readLoop passes keystrokes on to whichever prompt is reading, until the
+// client sends EOF or the connection goes
+func (t *remoteTerminal) readLoop() {
+	defer t.Close()
+	for {
+		m, err := t.readMessage()
+		if err != nil || m.Type == readline.T_EOF {
+			return
+		}
+		if m.Type == readline.T_DATA {
+			if _, err := t.inputW.Write(m.Data); err != nil {
+				return
+			}
+			continue
+		}
+		t.handle(m)
+	}
+}
+
+// handle takes in the client's terminal reports
+func (t *remoteTerminal) handle(m *readline.Message) {
+	if len(m.Data) < 2 {
+		return
+	}
+	value := binary.BigEndian.Uint16(m.Data)
+	switch m.Type {
+	case readline.T_ISTTY_REPORT:
+		atomic.StoreInt32(&t.isTerminal, int32(value))
+	case readline.T_WIDTH_REPORT:
+		atomic.StoreInt32(&t.width, int32(value))
+		if f, ok := t.onWidth.Load().(func()); ok {
+			f()
+		}
+	}
+}
+
+func (t *remoteTerminal) Read(b []byte) (int, error) {
+	return t.input.Read(b)
+}
+
+// Write sends output to the client's terminal
+func (t *remoteTerminal) Write(b []byte) (int, error) {
+	if err := t.send(readline.T_DATA, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *remoteTerminal) send(msgType readline.MsgType, data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := readline.NewMessage(msgType, data).WriteTo(t.conn)
+	if err != nil {
+		t.conn.Close()
+	}
+	return err
+}
+
+// Close ends the session, anything reading gets io.EOF
+func (t *remoteTerminal) Close() error {
+	t.closeOnce.Do(func() {
+		t.inputW.Close()
+		t.conn.Close()
+	})
+	return nil
+}
+
+// setup points a readline config at the client's terminal instead of ours
+func (t *remoteTerminal) setup(cfg *readline.Config) {
+	cfg.Stdin = t
+	cfg.Stdout = t
+	cfg.Stderr = t
+	cfg.FuncIsTerminal = func() bool { return atomic.LoadInt32(&t.isTerminal) != 0 }
+	cfg.FuncMakeRaw = func() error { return t.send(readline.T_RAW, nil) }
+	cfg.FuncExitRaw = func() error { return t.send(readline.T_ERAW, nil) }
+	cfg.FuncGetWidth = func() int { return int(atomic.LoadInt32(&t.width)) }
+	cfg.FuncOnWidthChanged = func(f func()) { t.onWidth.Store(f) }
+}
+
+// NewRemoteSession returns the menus for an operator connected from
+// keyserver-client, conn must have already been authenticated. Run it, then
+// Close it once done.
+func NewRemoteSession(conn net.Conn, operator string, h *servers.HttpServer, d *servers.DnsServer) (*CmdInfo, error) {
+	t, err := newRemoteTerminal(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &CmdInfo{
+		MenuType:      "Main",
+		TabCompleters: newCompleters(t.setup),
+		HttpServer:    h,
+		DnsServer:     d,
+		Operator:      operator,
+		Session:       conn.RemoteAddr().String(),
+		Out:           t,
+		terminal:      t,
+	}, nil
+}
+
+// WatchKeyChanges prints key changes made in other sessions as they happen,
+// including the same operator's, call the returned func to stop
+func (c *CmdInfo) WatchKeyChanges() func() {
+	events, stop := servers.Events.Subscribe(64)
+	go func() {
+		for e := range events {
+			if e.Type != servers.KeyChangeEvent || e.Session == c.Session {
+				continue
+			}
+			c.notify("[*] " + e.Operator + ": " + e.Message + "\n")
+		}
+	}()
+	return stop
+}
+
+// notify writes msg without trampling the prompt if the operator is typing
+func (c *CmdInfo) notify(msg string) {
+	for _, inst := range c.TabCompleters {
+		if inst.Terminal.IsReading() {
+			inst.Stdout().Write([]byte(msg))
+			return
+		}
+	}
+	c.print(msg)
+}
+
+// Close gives the terminal back, ending a remote session
+func (c *CmdInfo) Close() {
+	for _, inst := range c.TabCompleters {
+		inst.Close()
+	}
+	if c.terminal != nil {
+		c.terminal.Close()
+	}
+}
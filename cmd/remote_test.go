@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leoloobeek/keyserver/servers"
+	logging "github.com/op/go-logging"
+)
+
+// lockedBuffer is a terminal that's written to by the event goroutine
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestChangesShownInOtherSessions(t *testing.T) {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+
+	var sessions []*CmdInfo
+	for _, session := range []string{"10.0.0.1:40000", "10.0.0.2:40000"} {
+		c := &CmdInfo{Operator: "alice", Session: session, Out: &lockedBuffer{}}
+		stop := c.WatchKeyChanges()
+		defer stop()
+		sessions = append(sessions, c)
+	}
+
+	servers.KeyChange("alice", sessions[0].Session, "http", "page", "on", "off", "on")
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(sessions[1].Out.(*lockedBuffer).String(), "page") {
+		if time.Now().After(deadline) {
+			t.Fatal("Change wasn't shown in the operator's other session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out := sessions[0].Out.(*lockedBuffer).String(); out != "" {
+		t.Errorf("Change was echoed back to the session that made it: %q", out)
+	}
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// menuPrompts are the prompts for each menu, also printed before commands
+// run from a resource file
+var menuPrompts = map[string]string{
+	"Main":    "keyserver > ",
+	"Http":    "keyserver (http) > ",
+	"Dns":     "keyserver (dns) > ",
+	"HttpKey": "keyserver (httpkey) > ",
+	"DnsKey":  "keyserver (dnskey) > ",
+}
+
+// LoadScript reads a resource file of menu commands, one per line, exactly as
+// they'd be typed at the prompt. Blank lines and lines starting with # are skipped.
+func LoadScript(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var script []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		script = append(script, line)
+	}
+	return script, scanner.Err()
+}
+
+// Run loops through the menus until exit. Without TabCompleters there's no
+// prompt to read from, so it returns once the script has run out.
+func (c *CmdInfo) Run() {
+	for {
+		if c.TabCompleters == nil && len(c.Script) == 0 {
+			return
+		}
+		switch c.MenuType {
+		case "Main":
+			c.MainMenu()
+		case "Http":
+			c.HttpMenu()
+		case "Dns":
+			c.DnsMenu()
+		case "HttpKey":
+			c.HttpKeyMenu()
+		case "DnsKey":
+			c.DnsKeyMenu()
+		case "Quit":
+			return
+		default:
+			c.MenuType = "Main"
+		}
+	}
+}
+
+// StartServers starts the HTTP and/or DNS servers, for starting them from
+// the command line
+func (c *CmdInfo) StartServers(http, dns bool) {
+	if http && !c.HttpServer.IsRunning() {
+		c.startHttpServer(c.HttpServer)
+	}
+	if dns && !c.DnsServer.IsRunning() {
+		c.startDnsServer(c.DnsServer)
+	}
+}
+
+// Shutdown stops any running servers and gives the terminal back
+func (c *CmdInfo) Shutdown() {
+	if c.HttpServer.IsRunning() {
+		c.stopHttpServer(c.HttpServer)
+	}
+	if c.DnsServer.IsRunning() {
+		c.stopDnsServer(c.DnsServer)
+	}
+	c.Close()
+}
+
+// readLine returns the next command for the current menu, from the script
+// while there's any left and then from the prompt
+func (c *CmdInfo) readLine() (string, error) {
+	if len(c.Script) > 0 {
+		line := c.Script[0]
+		c.Script = c.Script[1:]
+		c.scripted = true
+		c.println(menuPrompts[c.MenuType] + line)
+		return line, nil
+	}
+	c.scripted = false
+	if c.TabCompleters == nil {
+		return "", io.EOF
+	}
+	line, err := c.TabCompleters[c.MenuType].Readline()
+	// a remote operator hung up, there's nothing more to read
+	if c.terminal != nil && err != nil && err != readline.ErrInterrupt {
+		c.MenuType = "Quit"
+		return line, io.EOF
+	}
+	return line, err
+}
+
+// setCompleter sets tab completion for the current menu, if there's a prompt
+func (c *CmdInfo) setCompleter(completer *readline.PrefixCompleter) {
+	if c.TabCompleters != nil {
+		c.TabCompleters[c.MenuType].Config.AutoComplete = completer
+	}
+}
+
+// confirm asks the question, scripted commands are confirmed without asking
+// as there's nobody there to answer
+func (c *CmdInfo) confirm(q string) bool {
+	if c.scripted {
+		c.println(q + "y")
+		return true
+	}
+	return c.askForPermission(q)
+}
@@ -0,0 +1,69 @@
+package main
+
+//
+// keyserver-client - connects to a keyserver team server so several
+// operators can use the menus at once
+//
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/chzyer/readline"
+	"github.com/leoloobeek/keyserver/team"
+)
+
+// passwordEnv is where the password is read from if set, rather than
+// prompting for it
+const passwordEnv = "KEYSERVER_PASSWORD"
+
+var (
+	serverAddr  = flag.String("server", "", "Team server to connect to, e.g. keyserver.example.com:50051")
+	operator    = flag.String("operator", os.Getenv("USER"), "Operator to log in as")
+	fingerprint = flag.String("fingerprint", "", "SHA-256 fingerprint of the team server's certificate, printed when it starts")
+	caFile      = flag.String("ca", "", "CA certificate to verify the team server's certificate with, instead of a fingerprint")
+)
+
+func main() {
+	flag.Parse()
+
+	if *serverAddr == "" || *operator == "" {
+		fmt.Println("[!] Use `keyserver-client -server <host:port> -operator <name> -fingerprint <sha256>`")
+		os.Exit(1)
+	}
+	if *fingerprint == "" && *caFile == "" {
+		fmt.Println("[*] No -fingerprint or -ca given, the server's certificate is checked against the system's roots")
+	}
+
+	password := os.Getenv(passwordEnv)
+	if password == "" {
+		p, err := readline.Password("[>] Password for " + *operator + ": ")
+		if err != nil {
+			os.Exit(1)
+		}
+		password = string(p)
+	}
+
+	conn, err := team.Dial(*serverAddr, *fingerprint, *caFile)
+	if err != nil {
+		fmt.Printf("[!] Error connecting to %s: %s\n", *serverAddr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	if err := team.Login(conn, *operator, password); err != nil {
+		fmt.Printf("[!] Error logging in: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[+] Connected to %s as %s\n\n", *serverAddr, *operator)
+
+	cli, err := readline.NewRemoteCli(conn)
+	if err != nil {
+		fmt.Printf("[!] Error starting the console: %s\n", err)
+		os.Exit(1)
+	}
+	cli.Serve()
+	fmt.Println()
+	fmt.Println("[*] Disconnected")
+}
@@ -5,43 +5,236 @@ package main
 //
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/chzyer/readline"
+	"github.com/leoloobeek/keyserver/api"
 	"github.com/leoloobeek/keyserver/cmd"
 	"github.com/leoloobeek/keyserver/logger"
 	"github.com/leoloobeek/keyserver/servers"
+	"github.com/leoloobeek/keyserver/team"
+)
+
+// keyFileInterval is how often HTTP key files are checked for changes
+const keyFileInterval = 10 * time.Second
+
+// stateFlushInterval is how often hit counters are saved, saving on every hit
+// would put a disk write in front of each response
+const stateFlushInterval = 5 * time.Second
+
+// apiTokenEnv is where the management API token is read from, rather than a
+// flag which would show up in the process list
+const apiTokenEnv = "KEYSERVER_API_TOKEN"
+
+var (
+	// stateFile holds keys, hit counters and server settings between runs
+	stateFile = flag.String("state", "keyserver.state", "File to restore keys, hit counters and server settings from, and save them to")
+	rcFile    = flag.String("rc", "", "Resource file of menu commands to run at startup, one per line")
+	startHttp = flag.Bool("http", false, "Start the HTTP server at startup, after the resource file has run")
+	startDns  = flag.Bool("dns", false, "Start the DNS server at startup, after the resource file has run")
+	daemon    = flag.Bool("daemon", false, "Run without the interactive prompt, stdin is never read. Stop with SIGTERM/SIGINT")
+	apiAddr   = flag.String("api", "", "Listen address for the management API, e.g. 127.0.0.1:8443. Disabled if empty")
+	apiCert   = flag.String("api-cert", "", "Certificate to serve the management API over TLS")
+	apiKey    = flag.String("api-key", "", "Private key to serve the management API over TLS")
+	teamAddr  = flag.String("team", "", "Listen address for operators connecting with keyserver-client, e.g. 0.0.0.0:50051. Disabled if empty")
+	teamCert  = flag.String("team-cert", "team.crt", "Certificate for the team server, a self signed one is generated if it doesn't exist")
+	teamKey   = flag.String("team-key", "team.key", "Private key for the team server's certificate")
+	operators = flag.String("operators", "operators.json", "File of operators allowed to connect to the team server")
+	addOp     = flag.String("add-operator", "", "Add an operator, or change their password, then exit")
+	auditFile = flag.String("audit", "keyserver.audit", "Append-only audit log of every change operators make to keys and servers")
+	verify    = flag.Bool("verify-audit", false, "Check the audit log hasn't been tampered with, then exit")
 )
 
 func main() {
+	flag.Parse()
 	fmt.Println()
 
+	if *addOp != "" {
+		addOperator(*addOp)
+		return
+	}
+	if *verify {
+		verifyAudit(*auditFile)
+		return
+	}
+
 	logger.Init()
 	logger.Log.Info("Keyserver starting up...")
 
+	httpServer := servers.GetHttpServer()
+	dnsServer := servers.GetDnsServer()
+
+	// Restore keys and settings from the last run and save any changes from here on
+	store := servers.NewStateStore(*stateFile, httpServer, dnsServer)
+	if err := store.Load(); err != nil {
+		fmt.Printf("[!] Error loading %s: %s\n", *stateFile, err)
+	} else if httpServer.KeyCount()+dnsServer.KeyCount() > 0 {
+		fmt.Printf("[*] Restored %d HTTP and %d DNS keys from %s\n", httpServer.KeyCount(), dnsServer.KeyCount(), *stateFile)
+	}
+	httpServer.OnChange = store.Persist
+	dnsServer.OnChange = store.Persist
+	httpServer.OnHit = store.MarkDirty
+	dnsServer.OnHit = store.MarkDirty
+	go store.FlushEvery(stateFlushInterval)
+
+	// Record every change from here on, the rc file's included
+	if err := servers.Audit.Open(*auditFile); err != nil {
+		fmt.Printf("[!] Error opening the audit log %s: %s\n", *auditFile, err)
+		os.Exit(1)
+	}
+
+	// Catch key files being edited after their hashes were built
+	go httpServer.WatchKeyFiles(keyFileInterval)
+
 	c := cmd.CmdInfo{
-		MenuType:      "Main",
-		TabCompleters: cmd.InitializeCompleters(),
-		HttpServer:    servers.GetHttpServer(),
-		DnsServer:     servers.GetDnsServer(),
-	}
-
-Endless:
-	for {
-		switch c.MenuType {
-		case "Main":
-			c.MainMenu()
-		case "Http":
-			c.HttpMenu()
-		case "Dns":
-			c.DnsMenu()
-		case "HttpKey":
-			c.HttpKeyMenu()
-		case "DnsKey":
-			c.DnsKeyMenu()
-		case "Quit":
-			break Endless
-		default:
-			c.MenuType = "Main"
+		MenuType:   "Main",
+		HttpServer: httpServer,
+		DnsServer:  dnsServer,
+		Operator:   "console",
+		Session:    "console",
+	}
+
+	// Run the resource file before there's a prompt, so nothing is read from stdin
+	if *rcFile != "" {
+		script, err := cmd.LoadScript(*rcFile)
+		if err != nil {
+			fmt.Printf("[!] Error reading %s: %s\n", *rcFile, err)
+			os.Exit(1)
+		}
+		c.Script = script
+		c.Run()
+	}
+	c.StartServers(*startHttp, *startDns)
+
+	// The management API comes up last so it sees the servers as configured
+	managementAPI := api.New(httpServer, dnsServer, os.Getenv(apiTokenEnv))
+	if *apiAddr != "" {
+		if managementAPI.Token == "" {
+			token, err := api.GenerateToken()
+			if err != nil {
+				fmt.Printf("[!] Error generating API token: %s\n", err)
+				os.Exit(1)
+			}
+			managementAPI.Token = token
+			fmt.Printf("[*] %s not set, generated API token: %s\n", apiTokenEnv, token)
+		}
+		if err := managementAPI.Start(*apiAddr, *apiCert, *apiKey); err != nil {
+			fmt.Printf("[!] Error starting the management API: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[+] Management API listening on %s\n", *apiAddr)
+	}
+
+	var teamServer *team.Server
+	if *teamAddr != "" {
+		teamServer = startTeamServer(httpServer, dnsServer)
+	}
+
+	shutdown := func() {
+		logger.Log.Info("Keyserver shutting down...")
+		if teamServer != nil {
+			teamServer.Stop()
 		}
+		managementAPI.Stop()
+		c.Shutdown()
+		store.Persist()
+		servers.Audit.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	// the resource file may have exited already
+	if c.MenuType == "Quit" {
+		shutdown()
+		return
+	}
+
+	if *daemon {
+		logger.Log.Info("Running as a daemon, stop with SIGTERM or SIGINT")
+		sig := <-signals
+		logger.Log.Infof("Received %s", sig)
+		shutdown()
+		return
+	}
+
+	c.TabCompleters = cmd.InitializeCompleters()
+	go func() {
+		sig := <-signals
+		fmt.Println()
+		logger.Log.Infof("Received %s", sig)
+		shutdown()
+		os.Exit(0)
+	}()
+
+	c.Run()
+	shutdown()
+}
+
+// startTeamServer starts accepting operators, exiting if it can't
+func startTeamServer(h *servers.HttpServer, d *servers.DnsServer) *team.Server {
+	ops, err := team.LoadOperators(*operators)
+	if err != nil {
+		fmt.Printf("[!] Error reading %s: %s\n", *operators, err)
+		os.Exit(1)
+	}
+	cert, err := team.LoadOrCreateCert(*teamCert, *teamKey)
+	if err != nil {
+		fmt.Printf("[!] Error loading the team server certificate: %s\n", err)
+		os.Exit(1)
+	}
+
+	teamServer := team.NewServer(h, d, ops)
+	if err := teamServer.Start(*teamAddr, cert); err != nil {
+		fmt.Printf("[!] Error starting the team server: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[+] Team server listening on %s\n", *teamAddr)
+	fmt.Printf("[*] Certificate fingerprint: %s\n", team.Fingerprint(cert))
+	return teamServer
+}
+
+// addOperator asks for the operator's password and saves it to the operators file
+func addOperator(name string) {
+	ops, err := team.LoadOperators(*operators)
+	if err != nil {
+		fmt.Printf("[!] Error reading %s: %s\n", *operators, err)
+		os.Exit(1)
+	}
+	password, err := readline.Password("[>] Password for " + name + ": ")
+	if err != nil {
+		os.Exit(1)
+	}
+	confirm, err := readline.Password("[>] Confirm password: ")
+	if err != nil {
+		os.Exit(1)
+	}
+	if string(password) != string(confirm) {
+		fmt.Println("[!] Passwords don't match")
+		os.Exit(1)
+	}
+	if err := ops.Add(name, string(password)); err != nil {
+		fmt.Printf("[!] Error adding operator: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[+] Operator %s saved to %s\n", name, *operators)
+}
+
+// verifyAudit checks the audit log's hash chain, exiting with 1 if it's been
+// tampered with
+func verifyAudit(path string) {
+	n, head, err := servers.VerifyAuditLog(path, "")
+	if err != nil {
+		fmt.Printf("[!] Audit log has been tampered with: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("[+] Audit log verified, %d entries\n", n)
+	if head != "" {
+		fmt.Printf("[*] Latest hash: %s\n", head)
 	}
 }
@@ -0,0 +1,432 @@
+package servers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoloobeek/keyserver/logger"
+)
+
+// SystemOperator is recorded for changes keyserver makes itself
+const SystemOperator = "system"
+
+// redacted replaces the value of secret key data in the audit log
+const redacted = "(redacted)"
+
+// maxAuditLine is the longest audit log entry read back, they hold at most
+// two copies of a key's settings
+const maxAuditLine = 1 << 20
+
+// Audit records every change operators make to keys and servers. It does
+// nothing until it's opened.
+var Audit = &AuditLog{}
+
+// AuditEntry is a single change. Each entry's Hash covers the entry and the
+// Hash of the one before it, so changing or removing an entry breaks the
+// chain from there on.
+type AuditEntry struct {
+	Seq      int
+	Time     time.Time
+	Operator string
+	Action   string // what was done, e.g. on, off, set, start
+	Protocol string // http or dns
+	Key      string `json:",omitempty"`
+	Setting  string `json:",omitempty"`
+	Before   string `json:",omitempty"` // for clone, the key it was copied from
+	After    string `json:",omitempty"`
+	Prev     string
+	Hash     string
+}
+
+// hash returns the entry's hash, calculated with Hash empty
+func (e *AuditEntry) hash() string {
+	c := *e
+	c.Hash = ""
+	data, _ := json.Marshal(&c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog appends entries to a file, one JSON entry per line
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seq  int
+	last string // Hash of the last entry
+}
+
+// Open opens the audit log for appending, carrying on the chain from the
+// last entry already in it. A log that doesn't verify isn't appended to, as
+// new entries would follow on from a chain that's already been broken.
+func (a *AuditLog) Open(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seq, last, err := VerifyAuditLog(path, "")
+	if os.IsNotExist(err) {
+		seq, last = 0, ""
+	} else if err != nil {
+		return errors.New("Audit log doesn't verify, check it with -verify-audit and move it aside to start a new one: " + err.Error())
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	a.path = path
+	a.file = file
+	a.seq = seq
+	a.last = last
+	return nil
+}
+
+// Close stops recording
+func (a *AuditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// Record fills in the entry's time and place in the chain and appends it
+func (a *AuditLog) Record(e *AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+
+	e.Seq = a.seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = a.last
+	e.Hash = e.hash()
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = a.file.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		logger.Log.Warningf("[ERROR] - Error writing to the audit log %s: %s", a.path, err)
+		return
+	}
+	a.seq = e.Seq
+	a.last = e.Hash
+}
+
+// Path returns the file being recorded to, "" if the audit log was never opened
+func (a *AuditLog) Path() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.path
+}
+
+// Entries reads back everything recorded so far
+func (a *AuditLog) Entries() ([]*AuditEntry, error) {
+	path := a.Path()
+	if path == "" {
+		return nil, errors.New("The audit log isn't enabled")
+	}
+	return ReadAuditLog(path)
+}
+
+// ReadAuditLog reads every entry from an audit log
+func ReadAuditLog(path string) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := scanAuditLog(path, func(n int, line []byte) error {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return errors.New("Line " + strconv.Itoa(n) + " isn't an audit entry, the log has been modified")
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// VerifyAuditLog checks each entry's hash and that it follows on from the
+// entry before, returning how many entries there are and the hash of the
+// last one. Removing entries from the end can't be seen in the chain itself,
+// so anchor can be the hash of an entry noted down earlier, e.g. in a report,
+// which must still be there.
+func VerifyAuditLog(path, anchor string) (int, string, error) {
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	last := ""
+	anchored := anchor == ""
+	for i, e := range entries {
+		seq := strconv.Itoa(i + 1)
+		if e.Seq != i+1 {
+			return i, last, errors.New("Entry " + seq + " is numbered " + strconv.Itoa(e.Seq) + ", entries have been removed or reordered")
+		}
+		if e.Prev != last {
+			return i, last, errors.New("Entry " + seq + " doesn't follow on from the entry before it, entries have been removed or modified")
+		}
+		if e.Hash != e.hash() {
+			return i, last, errors.New("Entry " + seq + " has been modified")
+		}
+		if strings.EqualFold(e.Hash, anchor) {
+			anchored = true
+		}
+		last = e.Hash
+	}
+	if !anchored {
+		return len(entries), last, errors.New("Hash " + anchor + " isn't in the log, entries have been removed from the end or the log has been rewritten")
+	}
+	return len(entries), last, nil
+}
+
+// scanAuditLog calls f with each non-empty line and its line number
+func scanAuditLog(path string, f func(int, []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditLine)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := f(n, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// KeyAuditEntries returns the entries for a key, including those from before
+// it was renamed
+func KeyAuditEntries(entries []*AuditEntry, key string) []*AuditEntry {
+	names := map[string]bool{strings.ToLower(key): true}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if e := entries[i]; e.Action == "rename" && names[strings.ToLower(e.After)] {
+			names[strings.ToLower(e.Key)] = true
+		}
+	}
+
+	found := []*AuditEntry{}
+	for _, e := range entries {
+		if e.Key != "" && names[strings.ToLower(e.Key)] {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// LiveWindow is a span of time a key was manually turned on, To is zero if
+// it's still on
+type LiveWindow struct {
+	From time.Time
+	To   time.Time
+}
+
+// KeyLiveWindows works out from the audit entries when the key was turned
+// on, following it through renames. Keys are also live whenever their
+// constraints match, which depends on each request.
+func KeyLiveWindows(entries []*AuditEntry, key string) []*LiveWindow {
+	// follow renames back to the name the key started with
+	for i := len(entries) - 1; i >= 0; i-- {
+		if e := entries[i]; e.Action == "rename" && strings.EqualFold(e.After, key) {
+			key = e.Key
+		}
+	}
+
+	var windows []*LiveWindow
+	var open *LiveWindow
+	name := key
+
+	for _, e := range entries {
+		if e.Key == "" || !strings.EqualFold(e.Key, name) {
+			continue
+		}
+		state := ""
+		switch e.Action {
+		case "rename":
+			name = e.After
+			continue
+		case "on", "off", "disable":
+			state = e.After
+		case "add", "import", "clone", "edit":
+			state = stateManualState(e.After)
+		case "remove":
+			state = "removed"
+		}
+		if state == "" {
+			continue
+		}
+		if state == "on" && open == nil {
+			open = &LiveWindow{From: e.Time}
+			windows = append(windows, open)
+		} else if state != "on" && open != nil {
+			open.To = e.Time
+			open = nil
+		}
+	}
+	return windows
+}
+
+// stateManualState returns on, off or disabled from an AuditState value
+func stateManualState(value string) string {
+	ks := &KeyState{}
+	if json.Unmarshal([]byte(value), ks) != nil {
+		return ""
+	}
+	switch {
+	case ks.Disabled:
+		return "disabled"
+	case ks.On:
+		return "on"
+	}
+	return "off"
+}
+
+// ManualState is how the key has been manually set, for the audit log
+func ManualState(k *Key) string {
+	switch {
+	case k.IsDisabled():
+		return "disabled"
+	case k.IsOn():
+		return "on"
+	}
+	return "off"
+}
+
+// AlertState is whether alerts are on for the key, for the audit log
+func AlertState(k *Key) string {
+	if k.AlertsEnabled() {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// HitState is the key's total hits, for the audit log
+func HitState(k *Key) string {
+	total := 0
+	for _, hits := range k.HitCounter() {
+		total += hits
+	}
+	return strconv.Itoa(total) + " hits"
+}
+
+// AuditState is the key's settings and state for the audit log, without its
+// hit history, anything read from its file or the values of secret data
+func AuditState(k *Key) string {
+	ks := k.ToState()
+	ks.HitCounter = nil
+	ks.LastHit = ""
+	ks.Material = ""
+	ks.Content = nil
+	for name, value := range ks.Data {
+		if data, ok := k.Data[name]; ok && data.Secret && value != "" {
+			ks.Data[name] = redacted
+		}
+	}
+	data, _ := json.Marshal(ks)
+	return string(data)
+}
+
+// keyChangeMessages describe each action in [KEYCHANGE] lines
+var keyChangeMessages = map[string]string{
+	"add":       "has been added",
+	"import":    "has been imported",
+	"clone":     "has been cloned from",
+	"edit":      "has been edited",
+	"rename":    "has been renamed to",
+	"remove":    "has been removed",
+	"on":        "has been turned on!",
+	"off":       "has been turned off!",
+	"disable":   "has been disabled! Constraints will have no effect.",
+	"alert":     "has had alerting enabled",
+	"noalert":   "has had alerting disabled",
+	"clearhits": "has had its hits cleared",
+	"rehash":    "has been re-hashed after its file changed",
+}
+
+// KeyChange records a change an operator made to a key in the audit log,
+// logs it and publishes it so every connected operator sees it. session is
+// where the change was made, so that session can skip its own changes.
+// keyType is "http" or "dns", action is one of keyChangeMessages, before and
+// after are the values that changed.
+func KeyChange(operator, session, keyType, name, action, before, after string) {
+	change := keyChangeMessages[action]
+	switch action {
+	case "clone":
+		change += " '" + before + "'"
+	case "rename":
+		change += " '" + after + "'"
+	}
+	msg := strings.ToUpper(keyType) + " Key '" + name + "' " + change
+	logger.Log.Noticef("[KEYCHANGE] - %s - %s", operator, msg)
+
+	Audit.Record(&AuditEntry{
+		Operator: operator,
+		Action:   action,
+		Protocol: keyType,
+		Key:      name,
+		Before:   before,
+		After:    after,
+	})
+	Events.Publish(Event{
+		Type:     KeyChangeEvent,
+		Time:     time.Now(),
+		Protocol: keyType,
+		Key:      name,
+		Operator: operator,
+		Session:  session,
+		Message:  msg,
+	})
+}
+
+// SettingChanges records each server setting an operator changed, before
+// and after are from SettingValues. action is set, unset or import.
+func SettingChanges(operator, serverType, action string, before, after map[string]string) {
+	var names []string
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if before[name] == after[name] {
+			continue
+		}
+		logger.Log.Noticef("[SETTING] - %s - %s setting '%s' changed from '%s' to '%s'", operator, strings.ToUpper(serverType), name, before[name], after[name])
+		Audit.Record(&AuditEntry{
+			Operator: operator,
+			Action:   action,
+			Protocol: serverType,
+			Setting:  name,
+			Before:   before[name],
+			After:    after[name],
+		})
+	}
+}
+
+// ServerChange records an operator starting or stopping a server
+func ServerChange(operator, serverType, action string) {
+	Audit.Record(&AuditEntry{
+		Operator: operator,
+		Action:   action,
+		Protocol: serverType,
+	})
+}
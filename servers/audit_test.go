@@ -0,0 +1,96 @@
+package servers
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestAudit records to a new audit log in dir until the test ends
+func openTestAudit(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "keyserver.audit")
+	if err := Audit.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Audit.Close)
+	return path
+}
+
+func TestAuditStateRedactsSecrets(t *testing.T) {
+	k := testDnsKey("mail", "key")
+	k.Data["HashAlgorithms"].Value = "hmac-sha256"
+	k.Data["HmacSecret"].Value = "hunter2"
+
+	state := AuditState(k)
+	if strings.Contains(state, "hunter2") {
+		t.Errorf("HmacSecret in the audit state: %s", state)
+	}
+	if !strings.Contains(state, redacted) {
+		t.Errorf("HmacSecret isn't marked as redacted: %s", state)
+	}
+}
+
+func TestAuditOpenRefusesBrokenChain(t *testing.T) {
+	_, _, dir := testServers(t)
+	path := openTestAudit(t, dir)
+	ServerChange("tester", "http", "start")
+	ServerChange("tester", "http", "stop")
+	Audit.Close()
+
+	// carries on from the last entry
+	if err := Audit.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	ServerChange("tester", "dns", "start")
+	Audit.Close()
+	if n, _, err := VerifyAuditLog(path, ""); err != nil || n != 3 {
+		t.Fatalf("Expected 3 verified entries, got %d: %v", n, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, broken := range map[string]string{
+		"unparseable": string(data) + "not an entry\n",
+		"modified":    strings.Replace(string(data), `"Action":"stop"`, `"Action":"start"`, 1),
+		"removed":     string(data[strings.Index(string(data), "\n")+1:]),
+	} {
+		if err := ioutil.WriteFile(path, []byte(broken), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := Audit.Open(path); err == nil {
+			Audit.Close()
+			t.Errorf("Opened an audit log with an entry %s", name)
+		}
+	}
+}
+
+func TestRehashIsAudited(t *testing.T) {
+	h, _, dir := testServers(t)
+	path := openTestAudit(t, dir)
+
+	file := filepath.Join(dir, "file.html")
+	k := testHttpKey(file, "/a")
+	k.Data["DriftPolicy"].Value = "rehash"
+	if err := h.AddKey(k, "a"); err != nil {
+		t.Fatal(err)
+	}
+	h.CheckKeyFiles()
+	if err := ioutil.WriteFile(file, []byte("<html>changed</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.CheckKeyFiles()
+
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "rehash" || entries[0].Operator != SystemOperator {
+		t.Fatalf("Expected a rehash entry from %s, got %d entries", SystemOperator, len(entries))
+	}
+	if entries[0].Before == entries[0].After {
+		t.Error("Rehash entry doesn't record the new hashes")
+	}
+}
@@ -0,0 +1,101 @@
+package servers
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// contentCache keeps the files served by the HttpServer in memory so requests
+// don't touch the disk. Entries are refreshed by CheckKeyFiles, and read
+// only goes back to the file if its size or modification time has changed.
+type contentCache struct {
+	mu    sync.RWMutex
+	files map[string]*cachedFile
+}
+
+type cachedFile struct {
+	data    []byte
+	size    int64
+	modTime time.Time
+}
+
+func newContentCache() *contentCache {
+	return &contentCache{files: make(map[string]*cachedFile)}
+}
+
+// get returns the cached file without touching the disk
+func (c *contentCache) get(path string) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if f, ok := c.files[path]; ok {
+		return f.data, true
+	}
+	return nil, false
+}
+
+// read returns the file, from the cache if it hasn't changed on disk
+func (c *contentCache) read(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		c.remove(path)
+		return nil, err
+	}
+
+	c.mu.RLock()
+	f, ok := c.files[path]
+	c.mu.RUnlock()
+	if ok && f.size == info.Size() && f.modTime.Equal(info.ModTime()) {
+		return f.data, nil
+	}
+
+	data, err := ReadFile(path)
+	if err != nil {
+		c.remove(path)
+		return nil, err
+	}
+	c.mu.Lock()
+	c.files[path] = &cachedFile{data: data, size: info.Size(), modTime: info.ModTime()}
+	c.mu.Unlock()
+	return data, nil
+}
+
+func (c *contentCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, path)
+}
+
+// prune drops any files not in paths
+func (c *contentCache) prune(paths map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.files {
+		if !paths[path] {
+			delete(c.files, path)
+		}
+	}
+}
+
+// LoadDefaultPage reads the DefaultPage into the cache so a missing or
+// unreadable page is found when it's set rather than when it's served
+func (h *HttpServer) LoadDefaultPage() error {
+	if path := h.Setting("DefaultPage"); path != "" {
+		_, err := h.cache.read(path)
+		return err
+	}
+	return nil
+}
+
+// keyContent returns what's served for an HTTP key: the content that was
+// hashed, which for a pinned key never changes
+func (h *HttpServer) keyContent(k *Key) ([]byte, error) {
+	k.mu.RLock()
+	content := k.content
+	k.mu.RUnlock()
+	if content != nil {
+		return content, nil
+	}
+	// restored keys that haven't been checked yet
+	return h.cache.read(k.Data["FilePath"].Value)
+}
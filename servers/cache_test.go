@@ -0,0 +1,96 @@
+package servers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheReadsChangedFiles(t *testing.T) {
+	_, _, dir := testServers(t)
+	path := filepath.Join(dir, "file.html")
+	c := newContentCache()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() string {
+		data, err := c.read(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	write("aaaa", modTime)
+	if got := read(); got != "aaaa" {
+		t.Fatalf("Read %q", got)
+	}
+
+	// same size and modification time, so the cached copy is used
+	write("bbbb", modTime)
+	if got := read(); got != "aaaa" {
+		t.Errorf("Unchanged file read from disk, got %q", got)
+	}
+	if got, ok := c.get(path); !ok || string(got) != "aaaa" {
+		t.Errorf("Cache get returned %q %v", got, ok)
+	}
+
+	write("cccc", modTime.Add(time.Second))
+	if got := read(); got != "cccc" {
+		t.Errorf("File with a new modification time not re-read, got %q", got)
+	}
+
+	write("ddddd", modTime.Add(time.Second))
+	if got := read(); got != "ddddd" {
+		t.Errorf("File with a new size not re-read, got %q", got)
+	}
+
+	os.Remove(path)
+	if _, err := c.read(path); err == nil {
+		t.Error("Removed file read from the cache")
+	}
+	if _, ok := c.get(path); ok {
+		t.Error("Removed file still cached")
+	}
+}
+
+func TestCheckKeyFilesRefreshesDefaultPage(t *testing.T) {
+	h, _, dir := testServers(t)
+	if body := serve(h, "/missing"); body != "<html>error.html</html>" {
+		t.Fatalf("Default page served as %q", body)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "error.html"), []byte("<html>new error</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.CheckKeyFiles()
+	if body := serve(h, "/missing"); body != "<html>new error</html>" {
+		t.Errorf("Changed default page not served, got %q", body)
+	}
+}
+
+func TestCheckKeyFilesPrunesCache(t *testing.T) {
+	h, _, dir := testServers(t)
+	file := filepath.Join(dir, "file.html")
+	if err := h.AddKey(testHttpKey(file, "/a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.cache.get(file); !ok {
+		t.Fatal("Key file wasn't cached when the key was added")
+	}
+
+	h.RemoveKey("a")
+	h.CheckKeyFiles()
+	if _, ok := h.cache.get(file); ok {
+		t.Error("Removed key's file still cached")
+	}
+}
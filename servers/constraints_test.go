@@ -0,0 +1,157 @@
+package servers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIPRangeMatching(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		ip         string
+		want       bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+		{"192.0.2.10", "192.0.2.10", true},
+		{"192.0.2.10", "192.0.2.11", false},
+		{"198.51.100.0/24, 10.0.0.0/8", "10.1.2.3", true},
+		{"2001:db8::/32", "2001:db8:1::1", true},
+		{"2001:db8::/32", "2001:db9::1", false},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"10.0.0.0/8", "::ffff:10.1.2.3", true},
+		{"10.0.0.0/8", "", false},
+	} {
+		if got := ipRangeConstraint(tc.constraint, net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("ipRangeConstraint(%q, %q) = %v, want %v", tc.constraint, tc.ip, got, tc.want)
+		}
+	}
+	if err := checkIPRanges("10.0.0.0/33"); err == nil {
+		t.Error("Invalid CIDR accepted")
+	}
+}
+
+func TestIPRangeIgnoresSpoofedForwardedFor(t *testing.T) {
+	h, _, dir := testServers(t)
+	k := testHttpKey(filepath.Join(dir, "file.html"), "/a")
+	k.Constraints["IPRange"].Constraint = "10.0.0.0/8"
+	if err := h.AddKey(k, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	served := func(remote, forwarded string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		r.RemoteAddr = remote + ":40000"
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return strings.Contains(w.Body.String(), "file.html")
+	}
+
+	if !served("10.1.2.3", "") {
+		t.Error("Key not served to a client in range")
+	}
+	if served("198.51.100.7", "10.1.2.3") {
+		t.Error("Key served for X-Forwarded-For from a client that isn't a trusted proxy")
+	}
+
+	if err := h.SetSetting("TrustedProxies", "192.0.2.1, 192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if !served("192.0.2.1", "10.1.2.3") {
+		t.Error("Key not served through a trusted proxy")
+	}
+	if !served("192.0.2.1", "10.1.2.3, 192.0.2.2") {
+		t.Error("Key not served through two trusted proxies")
+	}
+	if served("192.0.2.1", "10.1.2.3, 198.51.100.7") {
+		t.Error("Key served for an X-Forwarded-For entry the client sent itself")
+	}
+	if served("198.51.100.7", "10.1.2.3") {
+		t.Error("Key served for X-Forwarded-For from a client that isn't a trusted proxy")
+	}
+
+	if err := h.SetSetting("TrustedProxies", "not an ip"); err == nil {
+		t.Error("Invalid TrustedProxies accepted")
+	}
+}
+
+func TestIPRangeUsesResolverAddress(t *testing.T) {
+	_, d, _ := testServers(t)
+	k := testDnsKey("in", "key")
+	k.Constraints["IPRange"].Constraint = "127.0.0.0/8, ::1"
+	if err := d.AddKey(k, "in"); err != nil {
+		t.Fatal(err)
+	}
+	k = testDnsKey("out", "key")
+	k.Constraints["IPRange"].Constraint = "10.0.0.0/8"
+	if err := d.AddKey(k, "out"); err != nil {
+		t.Fatal(err)
+	}
+
+	// testResponseWriter's resolver is 127.0.0.1
+	if m := query(d, "in.example.com.", dns.TypeTXT); len(m.Answer) != 1 {
+		t.Error("Key not answered for a resolver in range")
+	}
+	if m := query(d, "out.example.com.", dns.TypeTXT); len(m.Answer) != 0 {
+		t.Error("Key answered for a resolver out of range")
+	}
+}
+
+func TestHeaderConstraint(t *testing.T) {
+	k := testHttpKey("file.html", "/a")
+	r := httptest.NewRequest(http.MethodGet, "/a", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+	r.Header.Set("X-Session", "abc123")
+
+	for _, tc := range []struct {
+		constraint string
+		want       bool
+	}{
+		{"X-Session: ^abc[0-9]+$", true},
+		{"x-session: ^abc[0-9]+$", true},
+		{"X-SESSION: ^abc", true},
+		{"X-Session: ^xyz", false},
+		{"User-Agent: Windows NT 10.0; Win64;; X-Session: abc", true},
+		{"User-Agent: Windows NT 10.0; Win64 ;; X-Session: xyz", false},
+		{"User-Agent: Linux;; X-Session: abc", false},
+		// a missing header is matched as empty
+		{"X-Missing: .+", false},
+		{"X-Missing: ^$", true},
+		{"X-Session: abc;; X-Missing: ^$", true},
+	} {
+		if err := checkHeaderPatterns(tc.constraint); err != nil {
+			t.Errorf("Check(%q): %s", tc.constraint, err)
+			continue
+		}
+		if got := k.HeaderHttpConstraint(tc.constraint, r); got != tc.want {
+			t.Errorf("HeaderHttpConstraint(%q) = %v, want %v", tc.constraint, got, tc.want)
+		}
+	}
+	if k.HeaderHttpConstraint("X-Session: abc", nil) {
+		t.Error("Header constraint matched without a request")
+	}
+
+	for _, constraint := range []string{
+		"X-Session",
+		": abc",
+		"X-Session: abc;; no colon",
+		"X-Session: (",
+		";;",
+	} {
+		if err := k.Constraints["Header"].Check(constraint); err == nil {
+			t.Errorf("Malformed Header constraint %q accepted", constraint)
+		}
+		if k.HeaderHttpConstraint(constraint, r) {
+			t.Errorf("Malformed Header constraint %q matched", constraint)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package servers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//
+// Payload encryption
+//
+// Payloads are encrypted with AES-256-GCM using a key derived from one of a
+// keyserver key's hashes (the hex string, as the stager computes it). The
+// output starts with a single header line so a stager knows how to derive the
+// key, followed by the raw ciphertext and GCM tag:
+//   KSENC1 alg=aes-256-gcm kdf=pbkdf2-sha256 iter=100000 hash=sha512 salt=<hex> nonce=<hex>\n
+//
+
+const (
+	payloadMagic     = "KSENC1"
+	payloadAlgorithm = "aes-256-gcm"
+
+	// DefaultKDF and DefaultIterations are used when EncryptOptions leaves them empty
+	DefaultKDF        = "pbkdf2-sha256"
+	DefaultIterations = 100000
+)
+
+// KDFs are the supported key derivation functions. sha256 is a single SHA256
+// of the hash, for stagers without PBKDF2 available.
+var KDFs = []string{"pbkdf2-sha256", "sha256"}
+
+// EncryptOptions chooses how a payload's key is derived
+type EncryptOptions struct {
+	Hash       string // which of the key's hashes to use, defaults to DefaultHash
+	KDF        string
+	Iterations int
+}
+
+// PayloadHeader describes how an encrypted payload was built
+type PayloadHeader struct {
+	Algorithm  string
+	KDF        string
+	Iterations int
+	Hash       string
+	Salt       []byte
+	Nonce      []byte
+}
+
+// String returns the header line written before the ciphertext
+func (ph *PayloadHeader) String() string {
+	return fmt.Sprintf("%s alg=%s kdf=%s iter=%d hash=%s salt=%s nonce=%s\n", payloadMagic,
+		ph.Algorithm, ph.KDF, ph.Iterations, ph.Hash, hex.EncodeToString(ph.Salt), hex.EncodeToString(ph.Nonce))
+}
+
+// DefaultHash picks the hash used for encryption when one isn't chosen,
+// sha512 if the key has it otherwise the first alphabetically
+func (k *Key) DefaultHash() string {
+	hashes := k.GetHashes()
+	if _, ok := hashes["sha512"]; ok {
+		return "sha512"
+	}
+	var algs []string
+	for alg := range hashes {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	if len(algs) == 0 {
+		return ""
+	}
+	return algs[0]
+}
+
+// DeriveKey derives the AES key from a hex encoded hash with the given KDF
+func DeriveKey(hash, kdf string, salt []byte, iterations int) ([]byte, error) {
+	switch kdf {
+	case "pbkdf2-sha256":
+		if iterations < 1 {
+			return nil, errors.New("Iterations must be at least 1")
+		}
+		return pbkdf2.Key([]byte(hash), salt, iterations, 32, sha256.New), nil
+	case "sha256":
+		sum := sha256.Sum256([]byte(hash))
+		return sum[:], nil
+	default:
+		return nil, errors.New("Unsupported KDF: " + kdf + ", use one of: " + strings.Join(KDFs, ", "))
+	}
+}
+
+// EncryptPayload encrypts plaintext with a key derived from one of k's hashes
+// returns: the header line followed by the ciphertext
+func EncryptPayload(k *Key, plaintext []byte, opts EncryptOptions) ([]byte, error) {
+	if opts.Hash == "" {
+		opts.Hash = k.DefaultHash()
+	}
+	hash, ok := k.GetHashes()[opts.Hash]
+	if !ok {
+		return nil, errors.New("Key doesn't have a " + opts.Hash + " hash, add it to the key's HashAlgorithms")
+	}
+	if opts.KDF == "" {
+		opts.KDF = DefaultKDF
+	}
+	if opts.Iterations == 0 {
+		opts.Iterations = DefaultIterations
+	}
+	if opts.KDF == "sha256" {
+		opts.Iterations = 1
+	}
+
+	header := &PayloadHeader{
+		Algorithm:  payloadAlgorithm,
+		KDF:        opts.KDF,
+		Iterations: opts.Iterations,
+		Hash:       opts.Hash,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(header.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := payloadCipher(hash, header)
+	if err != nil {
+		return nil, err
+	}
+	header.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(header.Nonce); err != nil {
+		return nil, err
+	}
+
+	out := []byte(header.String())
+	return gcm.Seal(out, header.Nonce, plaintext, nil), nil
+}
+
+// DecryptPayload reverses EncryptPayload given the hex encoded hash named in
+// the payload's header, mostly useful to check a payload before it's used
+func DecryptPayload(hash string, payload []byte) ([]byte, error) {
+	header, ciphertext, err := ParsePayloadHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := payloadCipher(hash, header)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("Invalid payload nonce, expected " + strconv.Itoa(gcm.NonceSize()) + " bytes")
+	}
+	return gcm.Open(nil, header.Nonce, ciphertext, nil)
+}
+
+// ParsePayloadHeader splits an encrypted payload into its header and ciphertext
+func ParsePayloadHeader(payload []byte) (*PayloadHeader, []byte, error) {
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 || !bytes.HasPrefix(payload, []byte(payloadMagic+" ")) {
+		return nil, nil, errors.New("Not a keyserver encrypted payload")
+	}
+
+	header := &PayloadHeader{}
+	fields := strings.Fields(string(payload[len(payloadMagic):end]))
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, errors.New("Invalid payload header field: " + field)
+		}
+		var err error
+		switch parts[0] {
+		case "alg":
+			header.Algorithm = parts[1]
+		case "kdf":
+			header.KDF = parts[1]
+		case "iter":
+			header.Iterations, err = strconv.Atoi(parts[1])
+		case "hash":
+			header.Hash = parts[1]
+		case "salt":
+			header.Salt, err = hex.DecodeString(parts[1])
+		case "nonce":
+			header.Nonce, err = hex.DecodeString(parts[1])
+		}
+		if err != nil {
+			return nil, nil, errors.New("Invalid payload header field: " + field)
+		}
+	}
+	if header.Algorithm != payloadAlgorithm {
+		return nil, nil, errors.New("Unsupported payload algorithm: " + header.Algorithm)
+	}
+	return header, payload[end+1:], nil
+}
+
+// EncryptFile encrypts inPath with k and writes the payload to outPath, only
+// readable by the owner until it's put wherever the stager fetches it from
+func EncryptFile(k *Key, inPath, outPath string, opts EncryptOptions) (*PayloadHeader, error) {
+	plaintext, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := EncryptPayload(k, plaintext, opts)
+	if err != nil {
+		return nil, err
+	}
+	header, _, err := ParsePayloadHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(outPath, payload, 0600); err != nil {
+		return nil, err
+	}
+	// WriteFile keeps the mode of a file that's already there
+	return header, os.Chmod(outPath, 0600)
+}
+
+func payloadCipher(hash string, header *PayloadHeader) (cipher.AEAD, error) {
+	key, err := DeriveKey(hash, header.KDF, header.Salt, header.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
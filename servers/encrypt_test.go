@@ -0,0 +1,122 @@
+package servers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEncryptKey(t *testing.T) *Key {
+	k := testDnsKey("mail", "key")
+	k.Data["HashAlgorithms"].Value = "sha512,sha256"
+	if err := k.buildHashes("key"); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	k := testEncryptKey(t)
+	plaintext := []byte("payload")
+	for _, kdf := range KDFs {
+		for _, hash := range []string{"sha512", "sha256"} {
+			payload, err := EncryptPayload(k, plaintext, EncryptOptions{Hash: hash, KDF: kdf, Iterations: 1000})
+			if err != nil {
+				t.Fatalf("%s %s: %s", kdf, hash, err)
+			}
+			header, _, err := ParsePayloadHeader(payload)
+			if err != nil {
+				t.Fatalf("%s %s: %s", kdf, hash, err)
+			}
+			if header.KDF != kdf || header.Hash != hash || len(header.Salt) != 16 || len(header.Nonce) != 12 {
+				t.Errorf("%s %s: header %s", kdf, hash, header)
+			}
+			decrypted, err := DecryptPayload(k.GetHashes()[hash], payload)
+			if err != nil || !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("%s %s: decrypted %q, %v", kdf, hash, decrypted, err)
+			}
+		}
+	}
+
+	if _, err := EncryptPayload(k, plaintext, EncryptOptions{Hash: "md5"}); err == nil {
+		t.Error("Encrypted with a hash the key doesn't have")
+	}
+	if _, err := EncryptPayload(k, plaintext, EncryptOptions{KDF: "scrypt"}); err == nil {
+		t.Error("Encrypted with an unsupported KDF")
+	}
+}
+
+func TestPayloadAuthentication(t *testing.T) {
+	k := testEncryptKey(t)
+	hash := k.GetHashes()["sha512"]
+	payload, err := EncryptPayload(k, []byte("payload"), EncryptOptions{Iterations: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, payload...)
+	tampered[len(tampered)-20] ^= 1
+	if _, err := DecryptPayload(hash, tampered); err == nil {
+		t.Error("Tampered ciphertext decrypted")
+	}
+	if _, err := DecryptPayload(k.GetHashes()["sha256"], payload); err == nil {
+		t.Error("Decrypted with the wrong key")
+	}
+	// a different salt derives a different key
+	salted := bytes.Replace(payload, []byte("salt="), []byte("salt=00"), 1)
+	if _, err := DecryptPayload(hash, salted); err == nil {
+		t.Error("Decrypted with a changed salt")
+	}
+}
+
+func TestMalformedPayloadHeaders(t *testing.T) {
+	k := testEncryptKey(t)
+	hash := k.GetHashes()["sha512"]
+	for name, payload := range map[string]string{
+		"empty":         "",
+		"no newline":    "KSENC1 alg=aes-256-gcm kdf=sha256 iter=1 hash=sha512 salt=00 nonce=000000000000000000000000",
+		"wrong magic":   "KSENC2 alg=aes-256-gcm kdf=sha256 iter=1 hash=sha512 salt=00 nonce=000000000000000000000000\nxx",
+		"no equals":     "KSENC1 alg=aes-256-gcm kdf\nxx",
+		"bad iter":      "KSENC1 alg=aes-256-gcm kdf=pbkdf2-sha256 iter=many hash=sha512 salt=00 nonce=000000000000000000000000\nxx",
+		"bad salt":      "KSENC1 alg=aes-256-gcm kdf=sha256 iter=1 hash=sha512 salt=zz nonce=000000000000000000000000\nxx",
+		"algorithm":     "KSENC1 alg=aes-128-cbc kdf=sha256 iter=1 hash=sha512 salt=00 nonce=000000000000000000000000\nxx",
+		"kdf":           "KSENC1 alg=aes-256-gcm kdf=md5 iter=1 hash=sha512 salt=00 nonce=000000000000000000000000\nxx",
+		"zero iter":     "KSENC1 alg=aes-256-gcm kdf=pbkdf2-sha256 iter=0 hash=sha512 salt=00 nonce=000000000000000000000000\nxx",
+		"short nonce":   "KSENC1 alg=aes-256-gcm kdf=sha256 iter=1 hash=sha512 salt=00 nonce=00\nxx",
+		"missing nonce": "KSENC1 alg=aes-256-gcm kdf=sha256 iter=1 hash=sha512 salt=00\nxx",
+	} {
+		if _, err := DecryptPayload(hash, []byte(payload)); err == nil {
+			t.Errorf("Payload with %s header decrypted", name)
+		}
+	}
+}
+
+func TestEncryptFileIsOwnerOnly(t *testing.T) {
+	k := testEncryptKey(t)
+	dir, err := ioutil.TempDir("", "keyserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "payload"), filepath.Join(dir, "payload.enc")
+	ioutil.WriteFile(in, []byte("payload"), 0644)
+	ioutil.WriteFile(out, []byte("old"), 0644)
+
+	if _, err := EncryptFile(k, in, out, EncryptOptions{Iterations: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Payload written with mode %o, want 600", info.Mode().Perm())
+	}
+	data, _ := ioutil.ReadFile(out)
+	if !strings.HasPrefix(string(data), payloadMagic+" ") {
+		t.Error("Payload doesn't start with the header")
+	}
+}
@@ -0,0 +1,180 @@
+package servers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ImportResult reports what happened to each key in an engagement file
+type ImportResult struct {
+	Imported  []string
+	Conflicts []string
+	Mismatch  []string
+	Failed    []string
+	Settings  []string
+}
+
+// listenerSettings are only read when a server starts, so importing different
+// values while it's running would leave the settings saying one thing while
+// the server does another
+var listenerSettings = map[string][]string{
+	"http": {"Listen", "Port", "CertPath", "KeyPath"},
+	"dns":  {"Listen", "Port", "Domain"},
+}
+
+// ExportEngagement writes all keys and server settings to an engagement file
+// so the setup can be reused. Hit counters are left out as they only make
+// sense for the current engagement. Files ending in .yaml or .yml are written
+// as YAML, anything else as JSON.
+//
+// The file holds everything needed to recreate the keys, including HMAC
+// secrets and the content of pinned files, so it's only readable by the owner.
+func ExportEngagement(path string, h *HttpServer, d *DnsServer) error {
+	snap := TakeSnapshot(h, d)
+	for _, ks := range snap.HttpKeys {
+		ks.HitCounter = nil
+		ks.LastHit = ""
+	}
+	for _, ks := range snap.DnsKeys {
+		ks.HitCounter = nil
+		ks.LastHit = ""
+	}
+
+	var data []byte
+	var err error
+	if isYAML(path) {
+		data, err = yaml.Marshal(snap)
+	} else {
+		data, err = json.MarshalIndent(snap, "", "    ")
+	}
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that's already there
+	return os.Chmod(path, 0600)
+}
+
+// ImportEngagement reads an engagement file and adds its keys and settings to
+// the servers. Keys whose names are already in use are reported as conflicts
+// and left alone. Hashes are recomputed from the key's content and any that
+// differ from the file's are reported, as payloads built from the old hash
+// will no longer decrypt. Settings are validated the same way as when they're
+// set by hand, and the import is refused if it would change where a running
+// server listens.
+func ImportEngagement(path string, h *HttpServer, d *DnsServer) (*ImportResult, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{}
+	if isYAML(path) {
+		err = yaml.Unmarshal(data, snap)
+	} else {
+		err = json.Unmarshal(data, snap)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkListeners("HTTP", "http", h.IsRunning(), &h.settingStore, snap.HttpSettings); err != nil {
+		return nil, err
+	}
+	if err := checkListeners("DNS", "dns", d.IsRunning(), &d.settingStore, snap.DnsSettings); err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	importSettings("http", snap.HttpSettings, &h.settingStore, h.SetSetting, h.UnsetSetting, result)
+	importSettings("dns", snap.DnsSettings, &d.settingStore, d.SetSetting, d.UnsetSetting, result)
+	importKeys(snap.HttpKeys, h.AddKey, h, d, result)
+	importKeys(snap.DnsKeys, d.AddKey, h, d, result)
+	return result, nil
+}
+
+// checkListeners returns an error if the server is running and values would
+// change any of its listener settings
+func checkListeners(label, serverType string, running bool, s *settingStore, values map[string]string) error {
+	if !running {
+		return nil
+	}
+	for _, name := range listenerSettings[serverType] {
+		if value, ok := values[name]; ok && value != s.Setting(name) {
+			return errors.New(label + " server is running, stop it before importing a different " + name)
+		}
+	}
+	return nil
+}
+
+// importSettings changes each known setting that differs from the file with
+// set, or unset when the file has the default, recording any that fail
+func importSettings(serverType string, values map[string]string, s *settingStore, set func(string, string) error, unset func(string) error, result *ImportResult) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	current := s.Settings()
+	for _, name := range names {
+		setting, ok := current[name]
+		if !ok || setting.Value == values[name] {
+			continue
+		}
+		var err error
+		if values[name] == setting.Default {
+			err = unset(name)
+		} else {
+			err = set(name, values[name])
+		}
+		if err != nil {
+			result.Settings = append(result.Settings, serverType+" "+name+": "+err.Error())
+		}
+	}
+}
+
+// importKeys rebuilds and adds each key with add, recording the outcome in result
+func importKeys(keys map[string]*KeyState, add func(*Key, string) error, h *HttpServer, d *DnsServer, result *ImportResult) {
+	for name, ks := range keys {
+		if keyNameInUse(name, h, d) {
+			result.Conflicts = append(result.Conflicts, name)
+			continue
+		}
+
+		k, err := ks.ToKey()
+		if err == nil {
+			err = add(k, name)
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, name+": "+err.Error())
+			continue
+		}
+		result.Imported = append(result.Imported, name)
+
+		for alg, hash := range ks.Hashes {
+			if current, ok := k.Hashes[alg]; ok && current != hash {
+				result.Mismatch = append(result.Mismatch, name+" ("+alg+")")
+			}
+		}
+	}
+}
+
+// keyNameInUse checks both servers as key names are shared by the CLI commands
+func keyNameInUse(name string, h *HttpServer, d *DnsServer) bool {
+	return h.FindKey(name) != "" || d.FindKey(name) != ""
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
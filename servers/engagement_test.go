@@ -0,0 +1,74 @@
+package servers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportIsOwnerOnly(t *testing.T) {
+	h, d, dir := testServers(t)
+	path := filepath.Join(dir, "engagement.json")
+	if err := ExportEngagement(path, h, d); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Export written with mode %o, want 600", info.Mode().Perm())
+	}
+}
+
+func TestImportValidatesSettings(t *testing.T) {
+	h, d, dir := testServers(t)
+	path := filepath.Join(dir, "engagement.json")
+	d.SetSetting("DefaultTTL", "120")
+	h.SetSetting("DefaultPage", filepath.Join(dir, "other.html"))
+	if err := ExportEngagement(path, h, d); err != nil {
+		t.Fatal(err)
+	}
+
+	h, d, _ = testServers(t)
+	os.Remove(filepath.Join(dir, "other.html"))
+	result, err := ImportEngagement(path, h, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Setting("DefaultTTL") != "120" {
+		t.Errorf("DefaultTTL wasn't imported, got %s", d.Setting("DefaultTTL"))
+	}
+	if h.Setting("DefaultPage") == filepath.Join(dir, "other.html") {
+		t.Error("DefaultPage imported without the file existing")
+	}
+	if len(result.Settings) != 1 {
+		t.Errorf("Expected the DefaultPage to fail, got %v", result.Settings)
+	}
+}
+
+func TestImportRefusesListenerChanges(t *testing.T) {
+	h, d, dir := testServers(t)
+	path := filepath.Join(dir, "engagement.json")
+	d.SetSetting("Listen", "127.0.0.1")
+	d.SetSetting("Port", "0")
+	d.SetSetting("Domain", "other.example")
+	if err := ExportEngagement(path, h, d); err != nil {
+		t.Fatal(err)
+	}
+
+	h, d, _ = testServers(t)
+	d.SetSetting("Listen", "127.0.0.1")
+	d.SetSetting("Port", "0")
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	if _, err := ImportEngagement(path, h, d); err == nil {
+		t.Fatal("Import changed the Domain of a running server")
+	}
+	if d.Setting("Domain") != "example.com" {
+		t.Errorf("Domain changed to %s", d.Setting("Domain"))
+	}
+}
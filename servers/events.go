@@ -0,0 +1,117 @@
+package servers
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Events receives an Event for every request the HTTP and DNS servers handle
+// and every change an operator makes to a key
+var Events = NewEventBus()
+
+// Event types
+const (
+	RequestEvent   = "request"
+	KeyChangeEvent = "keychange"
+)
+
+// Event describes either a single request and what it meant for a key, or a
+// change to a key. For requests Key is empty when the request didn't match any
+// key, otherwise there's one event for each key that was checked.
+type Event struct {
+	Type      string
+	Time      time.Time
+	Protocol  string // "http" or "dns"
+	Source    string `json:",omitempty"` // client address, X-Forwarded-For is included for HTTP
+	Request   string `json:",omitempty"` // "<method> <path>" for HTTP, the query name for DNS
+	Key       string
+	Active    bool
+	Reasons   string // why the key was active, or "disabled", from IsActive
+	UserAgent string `json:",omitempty"`
+	QueryType string `json:",omitempty"`
+	Operator  string `json:",omitempty"` // who changed the key
+	Session   string `json:",omitempty"` // where they changed it from, e.g. their team server connection
+	Message   string `json:",omitempty"` // what changed
+}
+
+// EventBus hands events out to every subscriber. Publishing never blocks, a
+// subscriber that falls behind misses events rather than slowing down requests.
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewEventBus returns an EventBus with no subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel of events buffering up to size of them, and a
+// func to call when done with it
+func (b *EventBus) Subscribe(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends the event to every subscriber with room for it
+func (b *EventBus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// httpEvent starts an event for a HTTP request, source is the logged address
+func httpEvent(r *http.Request, source string) Event {
+	return Event{
+		Type:      RequestEvent,
+		Time:      time.Now(),
+		Protocol:  "http",
+		Source:    source,
+		Request:   r.Method + " " + r.URL.Path,
+		UserAgent: r.Header.Get("User-Agent"),
+	}
+}
+
+// dnsEvent starts an event for a DNS query
+func dnsEvent(q *dns.Question, source net.Addr) Event {
+	e := Event{
+		Type:      RequestEvent,
+		Time:      time.Now(),
+		Protocol:  "dns",
+		Request:   q.Name,
+		QueryType: dns.TypeToString[q.Qtype],
+	}
+	if ip := addrToIP(source); ip != nil {
+		e.Source = ip.String()
+	}
+	return e
+}
+
+// keyEvent returns a copy of the event for a key that was checked
+func keyEvent(e Event, name string, active bool, reasons string) Event {
+	e.Key = name
+	e.Active = active
+	e.Reasons = reasons
+	return e
+}
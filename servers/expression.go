@@ -0,0 +1,360 @@
+package servers
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// Constraint expressions
+//
+// A key's Expression combines its constraints with && (and), || (or), ! (not)
+// and parentheses, for example: (Time && UserAgent) || Manual
+// Manual refers to the key being turned on with the 'on' command.
+//
+
+// ExpressionError describes where parsing an expression failed
+type ExpressionError struct {
+	Expression string
+	Pos        int
+	Msg        string
+}
+
+func (e *ExpressionError) Error() string {
+	return fmt.Sprintf("Expression error at position %d: %s", e.Pos+1, e.Msg)
+}
+
+// Pointer returns the expression with a caret underneath where the error is
+func (e *ExpressionError) Pointer() string {
+	return e.Expression + "\n" + strings.Repeat(" ", e.Pos) + "^"
+}
+
+// exprNode is a parsed expression which can be evaluated against a key's
+// constraints. eval returns whether it matched and the sub-expressions that matched.
+type exprNode interface {
+	eval(match func(name string) bool) (bool, []string)
+	idents() []*identNode
+	String() string
+}
+
+type identNode struct {
+	name string
+	pos  int
+}
+
+type notNode struct {
+	child exprNode
+}
+
+type andNode struct {
+	children []exprNode
+}
+
+type orNode struct {
+	children []exprNode
+}
+
+func (n *identNode) eval(match func(string) bool) (bool, []string) {
+	if match(n.name) {
+		return true, []string{n.name}
+	}
+	return false, nil
+}
+
+func (n *notNode) eval(match func(string) bool) (bool, []string) {
+	if matched, _ := n.child.eval(match); !matched {
+		return true, []string{n.String()}
+	}
+	return false, nil
+}
+
+// and evaluates every child so the reason shows what each part matched on
+func (n *andNode) eval(match func(string) bool) (bool, []string) {
+	var parts []string
+	for _, child := range n.children {
+		matched, reasons := child.eval(match)
+		if !matched {
+			return false, nil
+		}
+		if len(reasons) > 1 {
+			parts = append(parts, "("+strings.Join(reasons, ", ")+")")
+		} else {
+			parts = append(parts, reasons...)
+		}
+	}
+	return true, []string{strings.Join(parts, " && ")}
+}
+
+// or evaluates every child rather than stopping at the first match so all
+// matching reasons are reported, like IsActive always has
+func (n *orNode) eval(match func(string) bool) (bool, []string) {
+	var active bool
+	var reasons []string
+	for _, child := range n.children {
+		if matched, r := child.eval(match); matched {
+			active = true
+			reasons = append(reasons, r...)
+		}
+	}
+	return active, reasons
+}
+
+func (n *identNode) idents() []*identNode { return []*identNode{n} }
+func (n *notNode) idents() []*identNode   { return n.child.idents() }
+func (n *andNode) idents() []*identNode   { return childIdents(n.children) }
+func (n *orNode) idents() []*identNode    { return childIdents(n.children) }
+
+func (n *identNode) String() string { return n.name }
+
+func (n *notNode) String() string {
+	if _, ok := n.child.(*identNode); ok {
+		return "!" + n.child.String()
+	}
+	return "!(" + n.child.String() + ")"
+}
+
+func (n *andNode) String() string {
+	var parts []string
+	for _, child := range n.children {
+		if or, ok := child.(*orNode); ok && len(or.children) > 1 {
+			parts = append(parts, "("+child.String()+")")
+		} else {
+			parts = append(parts, child.String())
+		}
+	}
+	return strings.Join(parts, " && ")
+}
+
+func (n *orNode) String() string {
+	var parts []string
+	for _, child := range n.children {
+		parts = append(parts, child.String())
+	}
+	return strings.Join(parts, " || ")
+}
+
+func childIdents(children []exprNode) []*identNode {
+	var idents []*identNode
+	for _, child := range children {
+		idents = append(idents, child.idents()...)
+	}
+	return idents
+}
+
+//
+// Parsing
+//
+
+type exprToken struct {
+	kind  string // "ident", "&&", "||", "!", "(", ")" or "end"
+	value string
+	pos   int
+}
+
+// parseExpression parses a constraint expression, the returned error is an
+// *ExpressionError pointing at the problem
+func parseExpression(expr string) (exprNode, error) {
+	tokens, err := tokenizeExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{expr: expr, tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "end" {
+		return nil, p.errorf(tok, "unexpected '%s', expected && or ||", tok.value)
+	}
+	return node, nil
+}
+
+func tokenizeExpression(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, exprToken{kind: string(c), value: string(c), pos: i})
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(expr) || expr[i+1] != c {
+				return nil, &ExpressionError{expr, i, fmt.Sprintf("expected '%c%c'", c, c)}
+			}
+			op := string([]byte{c, c})
+			tokens = append(tokens, exprToken{kind: op, value: op, pos: i})
+			i += 2
+		case isIdentChar(c):
+			start := i
+			for i < len(expr) && isIdentChar(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", value: expr[start:i], pos: start})
+		default:
+			return nil, &ExpressionError{expr, i, fmt.Sprintf("unexpected character '%c'", c)}
+		}
+	}
+	return append(tokens, exprToken{kind: "end", value: "end of expression", pos: len(expr)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type exprParser struct {
+	expr   string
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "end" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) errorf(tok exprToken, format string, args ...interface{}) error {
+	return &ExpressionError{p.expr, tok.pos, fmt.Sprintf(format, args...)}
+}
+
+// or := and ('||' and)*
+func (p *exprParser) parseOr() (exprNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []exprNode{first}
+	for p.peek().kind == "||" {
+		p.next()
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &orNode{children}, nil
+}
+
+// and := unary ('&&' unary)*
+func (p *exprParser) parseAnd() (exprNode, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	children := []exprNode{first}
+	for p.peek().kind == "&&" {
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &andNode{children}, nil
+}
+
+// unary := '!' unary | ident | '(' or ')'
+func (p *exprParser) parseUnary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "!":
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child}, nil
+	case "ident":
+		return &identNode{tok.value, tok.pos}, nil
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != ")" {
+			return nil, p.errorf(closing, "expected ')' to close '(' at position %d, found '%s'", tok.pos+1, closing.value)
+		}
+		return node, nil
+	default:
+		return nil, p.errorf(tok, "expected a constraint name, '!' or '(', found '%s'", tok.value)
+	}
+}
+
+//
+// Keys
+//
+
+// SetExpression parses and sets the key's constraint expression. Every name
+// must be one of the key's constraints or Manual. An empty expression goes
+// back to the default behavior.
+func (k *Key) SetExpression(expr string) error {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		k.Expression = ""
+		k.expr = nil
+		return nil
+	}
+
+	node, err := parseExpression(expr)
+	if err != nil {
+		return err
+	}
+	for _, ident := range node.idents() {
+		if ident.name == "Manual" {
+			continue
+		}
+		if _, ok := k.Constraints[ident.name]; !ok {
+			return &ExpressionError{expr, ident.pos, "unknown constraint '" + ident.name + "'"}
+		}
+	}
+	k.Expression = expr
+	k.expr = node
+	return nil
+}
+
+// checkExpression ensures every constraint the expression uses has a value,
+// as unset constraints are removed when the key is added
+func checkExpression(k *Key) error {
+	if k.expr == nil {
+		return nil
+	}
+	for _, ident := range k.expr.idents() {
+		if ident.name == "Manual" {
+			continue
+		}
+		if kc, ok := k.Constraints[ident.name]; !ok || kc.Constraint == "" {
+			return fmt.Errorf("Expression uses constraint %s which isn't set", ident.name)
+		}
+	}
+	return nil
+}
+
+// defaultExpression is used when a key has no Expression. The key is active if
+// it's manually on or any constraint matches, but HitLimit always has to pass
+// so it turns the key off once the limit is reached.
+func defaultExpression(k *Key) exprNode {
+	either := &orNode{children: []exprNode{&identNode{name: "Manual"}}}
+	for _, name := range AlphabetizeConstraints(k.Constraints) {
+		if name != "HitLimit" && k.Constraints[name].Constraint != "" {
+			either.children = append(either.children, &identNode{name: name})
+		}
+	}
+	if kc, ok := k.Constraints["HitLimit"]; ok && kc.Constraint != "" {
+		return &andNode{children: []exprNode{either, &identNode{name: "HitLimit"}}}
+	}
+	return either
+}
@@ -0,0 +1,159 @@
+package servers
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpressionEval(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		matched []string // the names that match
+		want    bool
+		reasons []string
+		parsed  string
+	}{
+		{"A", []string{"A"}, true, []string{"A"}, "A"},
+		{"A", nil, false, nil, "A"},
+		{"A || B && C", []string{"B"}, false, nil, "A || B && C"},
+		{"A || B && C", []string{"A"}, true, []string{"A"}, "A || B && C"},
+		{"A || B && C", []string{"B", "C"}, true, []string{"B && C"}, "A || B && C"},
+		{"(A || B) && C", []string{"A"}, false, nil, "(A || B) && C"},
+		{"(A || B) && C", []string{"B", "C"}, true, []string{"B && C"}, "(A || B) && C"},
+		{"(A || B) && C", []string{"A", "B", "C"}, true, []string{"(A, B) && C"}, "(A || B) && C"},
+		{"A || B", []string{"A", "B"}, true, []string{"A", "B"}, "A || B"},
+		{"!A", nil, true, []string{"!A"}, "!A"},
+		{"!A", []string{"A"}, false, nil, "!A"},
+		{"!A && B", []string{"B"}, true, []string{"!A && B"}, "!A && B"},
+		{"!(A || B)", nil, true, []string{"!(A || B)"}, "!(A || B)"},
+		{"!(A || B)", []string{"B"}, false, nil, "!(A || B)"},
+		{"!!A", []string{"A"}, true, []string{"!(!A)"}, "!(!A)"},
+		{"  ( ( A ) )  ", []string{"A"}, true, []string{"A"}, "A"},
+	} {
+		node, err := parseExpression(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %s", tc.expr, err)
+			continue
+		}
+		if node.String() != tc.parsed {
+			t.Errorf("%q parsed as %q, want %q", tc.expr, node.String(), tc.parsed)
+		}
+		got, reasons := node.eval(func(name string) bool {
+			for _, m := range tc.matched {
+				if m == name {
+					return true
+				}
+			}
+			return false
+		})
+		if got != tc.want || !reflect.DeepEqual(reasons, tc.reasons) {
+			t.Errorf("%q with %v = %v %q, want %v %q", tc.expr, tc.matched, got, reasons, tc.want, tc.reasons)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{"A & B", 2, "expected '&&'"},
+		{"A | B", 2, "expected '||'"},
+		{"A && ", 5, "found 'end of expression'"},
+		{"(A || B", 7, "expected ')' to close '(' at position 1"},
+		{"A B", 2, "unexpected 'B'"},
+		{"A && $", 5, "unexpected character '$'"},
+		{")", 0, "found ')'"},
+		{"", 0, "found 'end of expression'"},
+	} {
+		_, err := parseExpression(tc.expr)
+		exprErr, ok := err.(*ExpressionError)
+		if !ok {
+			t.Errorf("%q: expected an ExpressionError, got %v", tc.expr, err)
+			continue
+		}
+		if exprErr.Pos != tc.pos || !strings.Contains(exprErr.Msg, tc.msg) {
+			t.Errorf("%q: error at %d %q, want %d %q", tc.expr, exprErr.Pos, exprErr.Msg, tc.pos, tc.msg)
+		}
+		if want := tc.expr + "\n" + strings.Repeat(" ", tc.pos) + "^"; exprErr.Pointer() != want {
+			t.Errorf("%q: Pointer() = %q, want %q", tc.expr, exprErr.Pointer(), want)
+		}
+	}
+
+	k := testDnsKey("mail", "key")
+	if err := k.SetExpression("Manual || UserAgent"); err == nil {
+		t.Error("DNS key accepted an HTTP constraint")
+	}
+}
+
+func TestHitLimitTurnsKeyOff(t *testing.T) {
+	_, d, _ := testServers(t)
+	k := testDnsKey("mail", "key")
+	k.Constraints["HitLimit"].Constraint = "2"
+	if err := d.AddKey(k, "mail"); err != nil {
+		t.Fatal(err)
+	}
+	k.SetOn(true)
+
+	for i := 0; i < 2; i++ {
+		if active, reasons := k.IsActive(nil, &DnsQuery{}); !active || reasons != "Manual && HitLimit" {
+			t.Fatalf("Hit %d: active %v (%s), want active (Manual && HitLimit)", i+1, active, reasons)
+		}
+		k.UpdateHits()
+	}
+	if active, _ := k.IsActive(nil, &DnsQuery{}); active {
+		t.Error("Key still active after reaching its HitLimit")
+	}
+}
+
+func TestKeyStatus(t *testing.T) {
+	h, _, dir := testServers(t)
+	file := filepath.Join(dir, "file.html")
+	add := func(name, expression string, constraints map[string]string) *Key {
+		k := testHttpKey(file, "/"+name)
+		for c, value := range constraints {
+			k.Constraints[c].Constraint = value
+		}
+		if err := k.SetExpression(expression); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.AddKey(k, name); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	on := add("on", "", map[string]string{"UserAgent": "curl"})
+	on.SetOn(true)
+	off := add("off", "", map[string]string{"UserAgent": "curl"})
+	notUA := add("not", "!UserAgent", map[string]string{"UserAgent": "curl"})
+	time := add("time", "", map[string]string{"Time": "00:00-23:59"})
+	limit := add("limit", "", map[string]string{"UserAgent": "curl", "HitLimit": "1"})
+	limit.UpdateHits()
+	mixed := add("mixed", "UserAgent && !Header", map[string]string{"UserAgent": "curl", "Header": "X-A: b"})
+	disabled := add("disabled", "", nil)
+	disabled.SetOn(true)
+	disabled.Disable()
+
+	for _, tc := range []struct {
+		key    *Key
+		status string
+		reason string
+	}{
+		{on, StatusActive, "Manual && HitLimit"},
+		{off, StatusDepends, "UserAgent"},
+		{notUA, StatusDepends, "UserAgent"},
+		{time, StatusActive, "Time && HitLimit"},
+		{limit, StatusInactive, ""},
+		{mixed, StatusDepends, "UserAgent, Header"},
+		{disabled, StatusInactive, "disabled"},
+	} {
+		status, reason := tc.key.Status()
+		if status != tc.status || reason != tc.reason {
+			t.Errorf("%s: %s (%s), want %s (%s)", tc.key.Data["URL"].Value, status, reason, tc.status, tc.reason)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package servers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -22,23 +24,30 @@ func (h *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// add cache control headers regardless of the response
 	h.cacheHTTPHeaders(w)
 
-	remoteAddr := parseProxyHeaders(r)
+	remoteAddr, client := h.clientAddress(r)
+	r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, client))
 
 	// Log all requests
 	logger.Log.Infof("[HTTP] - %s  \"%s %s\" \"%s\"", remoteAddr, r.Method, r.URL.Path, r.Header.Get("User-Agent"))
+	event := httpEvent(r, remoteAddr)
+	matched := false
 	// loop through all keys and see if any URL matches
-	for name, key := range h.Keys {
+	for name, key := range h.Keys() {
 		if r.URL.Path == key.Data["URL"].Value {
+			matched = true
 			// IsActive() will consider both manually setting the key and constraints
-			if active, _ := key.IsActive(r, nil); active {
-				fileBytes, err := ReadFile(key.Data["FilePath"].Value)
+			active, reasons := key.IsActive(r, nil)
+			Events.Publish(keyEvent(event, name, active, reasons))
+			if active {
+				fileBytes, err := h.keyContent(key)
 				if err != nil {
 					logger.Log.Warningf("[ERROR] - Error reading HTML file: %s", err)
 				} else {
 					key.UpdateHits()
+					h.hit()
 					msg := fmt.Sprintf("[HTTPKEY:ON] - Responding with active HTTP Key '%s'", name)
 					logger.Log.Noticef(msg)
-					if key.SendAlerts {
+					if key.AlertsEnabled() {
 						logger.Alerts.SendAlerts(msg)
 					}
 					w.Write(fileBytes)
@@ -46,22 +55,28 @@ func (h *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 			} else {
 				key.UpdateHits()
+				h.hit()
 				msg := fmt.Sprintf("[HTTPKEY:OFF] - Access attempt for inactive HTTP Key '%s'", name)
 				logger.Log.Warningf(msg)
-				if key.SendAlerts {
+				if key.AlertsEnabled() {
 					logger.Alerts.SendAlerts(msg)
 				}
 			}
 		}
 	}
+	if !matched {
+		Events.Publish(event)
+	}
 	w.Write(h.getDefaultPage())
 }
 
 // getDefaultPage returns the default page bytes or '404 Not Found'
 func (h *HttpServer) getDefaultPage() []byte {
-	if h.State["DefaultPage"].Value != "" {
-		fileBytes, err := ReadFile(h.State["DefaultPage"].Value)
-		if err == nil {
+	if path := h.Setting("DefaultPage"); path != "" {
+		if fileBytes, ok := h.cache.get(path); ok {
+			return fileBytes
+		}
+		if fileBytes, err := h.cache.read(path); err == nil {
 			return fileBytes
 		}
 	}
@@ -75,80 +90,198 @@ func (h *HttpServer) cacheHTTPHeaders(w http.ResponseWriter) {
 	w.Header().Set("Expires", "0")
 }
 
-// parseProxyHeaders helps keyserver work with redirectors
-func parseProxyHeaders(r *http.Request) string {
+// clientIPKey holds the client IP from clientAddress in a request's context
+type clientIPKey struct{}
+
+// clientAddress helps keyserver work with redirectors. Returns the address to
+// log along with the client IP. X-Forwarded-For is only believed for requests
+// from the TrustedProxies, as anyone can send it. Clients can put whatever
+// they like at the start of the header, so it's read from the right, skipping
+// entries added by trusted proxies, to the address the first redirector saw.
+func (h *HttpServer) clientAddress(r *http.Request) (string, net.IP) {
+	host := remoteHost(r)
+	ip := net.ParseIP(host)
 	hdr := r.Header.Get("X-Forwarded-For")
-	if hdr == "" {
-		return strings.Split(r.RemoteAddr, ":")[0]
+	trusted, _ := parseIPRanges(h.Setting("TrustedProxies"))
+	if hdr == "" || !inRanges(trusted, ip) {
+		return host, ip
+	}
+
+	entries := strings.Split(hdr, ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil || !inRanges(trusted, ip) {
+			break
+		}
+	}
+	return hdr + " (P)", ip
+}
+
+// remoteHost is the address the request's connection came from
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	return hdr + " (P)"
+	return host
 }
 
 //
 // DNS Handling
 //
 
-// ServeDNS handles the DNS queries
+// ServeDNS handles the DNS queries. The server is authoritative for the Domain
+// setting, queries outside of it are refused and keys are matched on the
+// hostname relative to the domain.
 func (d *DnsServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
+	m.Authoritative = true
 
+	zone := d.zone()
 	for _, q := range r.Question {
+		if !dns.IsSubDomain(zone, q.Name) {
+			logger.Log.Infof("[DNS] - Refused %s query for %s, outside of %s", dns.TypeToString[q.Qtype], q.Name, zone)
+			Events.Publish(dnsEvent(&q, w.RemoteAddr()))
+			m.Authoritative = false
+			m.SetRcode(r, dns.RcodeRefused)
+			break
+		}
+		if d.answerZone(q, zone, m) {
+			logger.Log.Infof("[DNS] - Answered %s query for %s", dns.TypeToString[q.Qtype], q.Name)
+			Events.Publish(dnsEvent(&q, w.RemoteAddr()))
+			continue
+		}
+
+		hostname := relativeName(zone, q.Name)
 		switch q.Qtype {
-		case dns.TypeA:
-			logger.Log.Infof("[DNS] - Received A query for %s", q.Name)
-			resp, ttl, keyName := d.getActiveDNSKeys(&q)
-			if resp != "" {
-				ipResp := net.ParseIP(resp)
-				if ipResp != nil {
-					d.AppendResult(q, m, &dns.A{A: ipResp}, d.getTTL(ttl))
-					w.WriteMsg(m)
+		case dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeCNAME, dns.TypeMX, dns.TypeSRV, dns.TypeNS:
+			logger.Log.Infof("[DNS] - Received %s query for %s", dns.TypeToString[q.Qtype], q.Name)
+			key, keyName, resp := d.getActiveDNSKeys(&q, hostname, w.RemoteAddr())
+			if key != nil && resp != "" {
+				rrs, err := keyRecords(q.Qtype, key, resp)
+				if err == nil {
+					for _, rr := range rrs {
+						d.AppendResult(q, m, rr, d.getTTL(key.Data["TTL"].Value))
+					}
+					writeMsg(w, r, m)
 					return
 				}
-				logger.Log.Warningf("[ERROR] - DNS Key '%s' response is not a valid IP, no response returned", keyName)
+				logger.Log.Warningf("[ERROR] - DNS Key '%s' response is not valid, no response returned: %s", keyName, err)
 			}
-			m.SetRcode(r, 3) // 3 - NXDomain  - Non-Existent Domain
-		case dns.TypeTXT:
-			logger.Log.Infof("[DNS] - Received TXT query for %s", q.Name)
-			resp, ttl, _ := d.getActiveDNSKeys(&q)
-			if resp != "" {
-				d.AppendResult(q, m, &dns.TXT{Txt: []string{resp}}, d.getTTL(ttl))
-				w.WriteMsg(m)
-				return
+			// names with a key of another type, or one that's off, still exist
+			// so there's just no data. Resolvers cache NXDomain for the name and
+			// everything below it (RFC 8020), which would hide those keys.
+			if !d.nameExists(zone, hostname) {
+				m.SetRcode(r, 3) // 3 - NXDomain  - Non-Existent Domain
 			}
-			m.SetRcode(r, 3) // 3 - NXDomain  - Non-Existent Domain
+		default:
+			Events.Publish(dnsEvent(&q, w.RemoteAddr()))
 		}
+		// negative answers include the SOA so resolvers know how long to cache them
+		m.Ns = append(m.Ns, d.soa(zone))
+	}
+	writeMsg(w, r, m)
+}
+
+// writeMsg sends the response. Over UDP the answer has to fit within 512 bytes,
+// or the resolver's EDNS0 buffer size, otherwise records are dropped and the
+// TC bit is set so the resolver retries over TCP.
+func writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if w.LocalAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+			m.SetEdns0(opt.UDPSize(), false)
+		}
+		m.Truncate(size)
 	}
 	w.WriteMsg(m)
 }
 
-// getActiveDNSKeys is leveraged by ServeDNS to get any active key responses back
-// returns: DNS response, TTL, and key name
-func (d *DnsServer) getActiveDNSKeys(q *dns.Question) (string, string, string) {
-	hostname := strings.Split(q.Name, ".")[0]
+// getActiveDNSKeys is leveraged by ServeDNS to get any active key back. Keys with
+// an exact hostname are checked before wildcard and regex keys.
+// returns: the active key, or nil if there isn't one, key name and DNS response
+func (d *DnsServer) getActiveDNSKeys(q *dns.Question, hostname string, source net.Addr) (*Key, string, string) {
+	query := &DnsQuery{Question: q, Source: addrToIP(source)}
+	event := dnsEvent(q, source)
+	matchedKey := false
+	keys := d.Keys()
+	var names []string
+	for name, key := range keys {
+		if key.hostnameRe == nil {
+			names = append([]string{name}, names...)
+		} else {
+			names = append(names, name)
+		}
+	}
+
 	// loop through all keys and see if any record and hostname matches
-	for name, key := range d.Keys {
-		if hostname == key.Data["Hostname"].Value && q.Qtype == recordStringToUint(key.Data["RecordType"].Value) {
-			// IsActive() will consider both manually setting the key and constraints
-			if active, _ := key.IsActive(nil, q); active {
-				key.UpdateHits()
-				msg := fmt.Sprintf("[DNSKEY:ON] - Responding with active DNS Key '%s'", name)
-				logger.Log.Noticef(msg)
-				if key.SendAlerts {
-					logger.Alerts.SendAlerts(msg)
-				}
-				return key.Data["Response"].Value, key.Data["TTL"].Value, name
-			} else {
-				key.UpdateHits()
-				msg := fmt.Sprintf("[DNSKEY:OFF] - Access attempt for inactive DNS Key '%s'", name)
-				logger.Log.Warningf(msg)
-				if key.SendAlerts {
-					logger.Alerts.SendAlerts(msg)
-				}
+	for _, name := range names {
+		key := keys[name]
+		if q.Qtype != recordStringToUint(key.Data["RecordType"].Value) {
+			continue
+		}
+		matched, resp := key.MatchHostname(hostname)
+		if !matched {
+			continue
+		}
+		matchedKey = true
+		matchedMsg := ""
+		if key.hostnameRe != nil {
+			matchedMsg = fmt.Sprintf(" (matched '%s')", hostname)
+		}
+
+		// IsActive() will consider both manually setting the key and constraints
+		active, reasons := key.IsActive(nil, query)
+		Events.Publish(keyEvent(event, name, active, reasons))
+		if active {
+			key.UpdateHits()
+			d.hit()
+			msg := fmt.Sprintf("[DNSKEY:ON] - Responding with active DNS Key '%s'%s", name, matchedMsg)
+			logger.Log.Noticef(msg)
+			if key.AlertsEnabled() {
+				logger.Alerts.SendAlerts(msg)
+			}
+			return key, name, resp
+		} else {
+			key.UpdateHits()
+			d.hit()
+			msg := fmt.Sprintf("[DNSKEY:OFF] - Access attempt for inactive DNS Key '%s'%s", name, matchedMsg)
+			logger.Log.Warningf(msg)
+			if key.AlertsEnabled() {
+				logger.Alerts.SendAlerts(msg)
 			}
 		}
 	}
-	return "", "", ""
+	if !matchedKey {
+		Events.Publish(event)
+	}
+	return nil, "", ""
+}
+
+// nameExists returns whether the hostname is the zone itself, a nameserver or
+// has a key, whatever the key's record type or state. Names with one of these
+// below them exist as well.
+func (d *DnsServer) nameExists(zone, hostname string) bool {
+	if hostname == "@" {
+		return true
+	}
+	for _, key := range d.Keys() {
+		if matched, _ := key.MatchHostname(hostname); matched {
+			return true
+		}
+		if key.hostnameRe == nil && strings.HasSuffix(strings.ToLower(key.Data["Hostname"].Value), "."+hostname) {
+			return true
+		}
+	}
+	name := hostname + "." + zone
+	for _, ns := range d.nameserverNames(zone) {
+		if ns == name || strings.HasSuffix(ns, "."+name) {
+			return true
+		}
+	}
+	return false
 }
 
 // AppendResult prepares response for ServeDNS
@@ -159,6 +292,15 @@ func (is *DnsServer) AppendResult(q dns.Question, m *dns.Msg, rr dns.RR, ttl uin
 	if rrS, ok := rr.(*dns.A); ok {
 		hdr.Rrtype = dns.TypeA
 		rrS.Hdr = hdr
+	} else if rrS, ok := rr.(*dns.AAAA); ok {
+		hdr.Rrtype = dns.TypeAAAA
+		rrS.Hdr = hdr
+	} else if rrS, ok := rr.(*dns.MX); ok {
+		hdr.Rrtype = dns.TypeMX
+		rrS.Hdr = hdr
+	} else if rrS, ok := rr.(*dns.SRV); ok {
+		hdr.Rrtype = dns.TypeSRV
+		rrS.Hdr = hdr
 	} else if rrS, ok := rr.(*dns.CNAME); ok {
 		hdr.Rrtype = dns.TypeCNAME
 		rrS.Hdr = hdr
@@ -178,17 +320,173 @@ func (is *DnsServer) AppendResult(q dns.Question, m *dns.Msg, rr dns.RR, ttl uin
 
 }
 
+// addrToIP pulls the IP out of the resolver's address
+func addrToIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
 func recordStringToUint(record string) uint16 {
-	switch record {
+	switch strings.ToUpper(record) {
 	case "TXT":
 		return dns.TypeTXT
 	case "A":
 		return dns.TypeA
+	case "AAAA":
+		return dns.TypeAAAA
+	case "CNAME":
+		return dns.TypeCNAME
+	case "MX":
+		return dns.TypeMX
+	case "SRV":
+		return dns.TypeSRV
+	case "NS":
+		return dns.TypeNS
 	default:
 		return dns.TypeNone
 	}
 }
 
+// buildRR turns a key's response into a record of the given type. This is also
+// used to validate the response when a DNS key is added. Expected formats:
+//
+//	A, AAAA:    an IPv4 or IPv6 address
+//	CNAME, NS:  a hostname
+//	MX:         "<preference> <hostname>"
+//	SRV:        "<priority> <weight> <port> <target>"
+//	TXT:        any text
+func buildRR(rrtype uint16, resp string) (dns.RR, error) {
+	fields := strings.Fields(resp)
+	switch rrtype {
+	case dns.TypeA:
+		ip := net.ParseIP(resp)
+		if ip == nil || ip.To4() == nil {
+			return nil, errors.New("A response must be an IPv4 address")
+		}
+		return &dns.A{A: ip.To4()}, nil
+	case dns.TypeAAAA:
+		ip := net.ParseIP(resp)
+		if ip == nil || ip.To4() != nil {
+			return nil, errors.New("AAAA response must be an IPv6 address")
+		}
+		return &dns.AAAA{AAAA: ip}, nil
+	case dns.TypeCNAME:
+		target, err := parseHostname(resp)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.CNAME{Target: target}, nil
+	case dns.TypeNS:
+		ns, err := parseHostname(resp)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.NS{Ns: ns}, nil
+	case dns.TypeMX:
+		if len(fields) != 2 {
+			return nil, errors.New("MX response must be '<preference> <hostname>'")
+		}
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, errors.New("MX preference must be a number from 0-65535")
+		}
+		mx, err := parseHostname(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return &dns.MX{Preference: uint16(pref), Mx: mx}, nil
+	case dns.TypeSRV:
+		if len(fields) != 4 {
+			return nil, errors.New("SRV response must be '<priority> <weight> <port> <target>'")
+		}
+		var values [3]uint16
+		for i := 0; i < 3; i++ {
+			v, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, errors.New("SRV priority, weight and port must be numbers from 0-65535")
+			}
+			values[i] = uint16(v)
+		}
+		target, err := parseHostname(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		return &dns.SRV{Priority: values[0], Weight: values[1], Port: values[2], Target: target}, nil
+	case dns.TypeTXT:
+		return &dns.TXT{Txt: splitTXT(resp, maxTXTString)}, nil
+	default:
+		return nil, errors.New("Unsupported record type")
+	}
+}
+
+// maxTXTString is the longest character-string allowed in a TXT record
+const maxTXTString = 255
+
+// keyRecords builds the records answering a query for an active key from its
+// (expanded) response. Long TXT
+// responses are split into 255 byte character-strings within one record, or
+// with TXTSplit set to 'records', spread across multiple records each prefixed
+// with its index ("0:", "1:", ...) as resolvers are free to reorder them.
+func keyRecords(rrtype uint16, key *Key, resp string) ([]dns.RR, error) {
+	if rrtype == dns.TypeTXT && key.Data["TXTSplit"].Value == "records" {
+		var rrs []dns.RR
+		for i, chunk := range splitTXTRecords(resp) {
+			rrs = append(rrs, &dns.TXT{Txt: []string{strconv.Itoa(i) + ":" + chunk}})
+		}
+		return rrs, nil
+	}
+	rr, err := buildRR(rrtype, resp)
+	if err != nil {
+		return nil, err
+	}
+	return []dns.RR{rr}, nil
+}
+
+// splitTXT breaks s into strings no longer than size bytes
+func splitTXT(s string, size int) []string {
+	if len(s) <= size {
+		return []string{s}
+	}
+	var chunks []string
+	for len(s) > size {
+		chunks = append(chunks, s[:size])
+		s = s[size:]
+	}
+	if len(s) > 0 {
+		chunks = append(chunks, s)
+	}
+	return chunks
+}
+
+// splitTXTRecords breaks s into chunks that still fit in one character-string
+// once the "<index>:" prefix is added
+func splitTXTRecords(s string) []string {
+	var chunks []string
+	for i := 0; len(s) > 0 || i == 0; i++ {
+		size := maxTXTString - len(strconv.Itoa(i)+":")
+		if len(s) <= size {
+			chunks = append(chunks, s)
+			break
+		}
+		chunks = append(chunks, s[:size])
+		s = s[size:]
+	}
+	return chunks
+}
+
+// parseHostname validates a hostname used in a response and makes it fully qualified
+func parseHostname(name string) (string, error) {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", errors.New("Invalid hostname: " + name)
+	}
+	return dns.Fqdn(name), nil
+}
+
 // If theres a TTL for the key, return that
 func (d *DnsServer) getTTL(value string) uint {
 	if value != "" {
@@ -197,5 +495,20 @@ func (d *DnsServer) getTTL(value string) uint {
 			return uint(ttl)
 		}
 	}
-	return d.DefaultTTL
+	return d.defaultTTL()
+}
+
+// defaultTTL is the DefaultTTL setting, or its default if it isn't valid
+func (d *DnsServer) defaultTTL() uint {
+	return d.ttlSetting("DefaultTTL")
+}
+
+// ttlSetting returns a TTL setting, or its default if it isn't valid, such as
+// from an old state file
+func (d *DnsServer) ttlSetting(name string) uint {
+	ttl, err := parseTTL(d.Setting(name))
+	if err != nil {
+		ttl, _ = parseTTL(d.State[name].Default)
+	}
+	return ttl
 }
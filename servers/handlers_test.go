@@ -0,0 +1,154 @@
+package servers
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// query sends a question straight to the DNS server's handler
+func query(d *DnsServer, name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	w := &testResponseWriter{}
+	d.ServeDNS(w, r)
+	return w.msg
+}
+
+func TestNoDataForExistingNames(t *testing.T) {
+	_, d, _ := testServers(t)
+	if err := d.AddKey(testDnsKey("mail", "key"), "mail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddKey(testDnsKey("a.deep", "key"), "deep"); err != nil {
+		t.Fatal(err)
+	}
+	d.GetKey("mail").SetOn(true)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"mail.example.com.", dns.TypeTXT, dns.RcodeSuccess},   // answered
+		{"mail.example.com.", dns.TypeA, dns.RcodeSuccess},     // key of another type
+		{"a.deep.example.com.", dns.TypeTXT, dns.RcodeSuccess}, // key that's off
+		{"deep.example.com.", dns.TypeTXT, dns.RcodeSuccess},   // a key below it
+		{"ns1.example.com.", dns.TypeAAAA, dns.RcodeSuccess},   // nameserver without glue
+		{"example.com.", dns.TypeTXT, dns.RcodeSuccess},
+		{"other.example.com.", dns.TypeTXT, dns.RcodeNameError},
+		{"x.mail.example.com.", dns.TypeTXT, dns.RcodeNameError},
+	} {
+		m := query(d, tc.name, tc.qtype)
+		if m.Rcode != tc.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", dns.TypeToString[tc.qtype], tc.name, dns.RcodeToString[m.Rcode], dns.RcodeToString[tc.rcode])
+		}
+		if len(m.Answer) == 0 && (len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Errorf("%s %s: negative answer without the SOA", dns.TypeToString[tc.qtype], tc.name)
+		}
+	}
+
+	if m := query(d, "mail.example.com.", dns.TypeTXT); len(m.Answer) != 1 {
+		t.Errorf("Expected the active key to be answered, got %d answers", len(m.Answer))
+	}
+}
+
+func TestRefusedOutsideZone(t *testing.T) {
+	_, d, _ := testServers(t)
+	for _, name := range []string{"example.org.", "mail.example.org.", "notexample.com."} {
+		m := query(d, name, dns.TypeA)
+		if m.Rcode != dns.RcodeRefused || m.Authoritative {
+			t.Errorf("%s: rcode %s authoritative %v, want a non-authoritative REFUSED", name, dns.RcodeToString[m.Rcode], m.Authoritative)
+		}
+	}
+}
+
+func TestSOAAndNSWithGlue(t *testing.T) {
+	_, d, _ := testServers(t)
+	d.SetSetting("Nameservers", "ns1,ns2,ns.other.net")
+	d.SetSetting("NameserverIPs", "192.0.2.1,2001:db8::2,192.0.2.3")
+	d.SetSetting("NegativeTTL", "30")
+
+	m := query(d, "example.com.", dns.TypeSOA)
+	if len(m.Answer) != 1 {
+		t.Fatalf("Expected one SOA, got %d answers", len(m.Answer))
+	}
+	soa := m.Answer[0].(*dns.SOA)
+	if soa.Ns != "ns1.example.com." || soa.Minttl != 30 {
+		t.Errorf("SOA has Ns %s Minttl %d, want ns1.example.com. and 30", soa.Ns, soa.Minttl)
+	}
+
+	m = query(d, "example.com.", dns.TypeNS)
+	var ns []string
+	for _, rr := range m.Answer {
+		ns = append(ns, rr.(*dns.NS).Ns)
+	}
+	if len(ns) != 3 || ns[0] != "ns1.example.com." || ns[2] != "ns.other.net." {
+		t.Errorf("NS records %v", ns)
+	}
+	// no glue for the nameserver outside the zone
+	if len(m.Extra) != 2 {
+		t.Fatalf("Expected 2 glue records, got %d", len(m.Extra))
+	}
+	if a, ok := m.Extra[0].(*dns.A); !ok || a.Hdr.Name != "ns1.example.com." || a.A.String() != "192.0.2.1" {
+		t.Errorf("Glue for ns1 is %s", m.Extra[0])
+	}
+	if aaaa, ok := m.Extra[1].(*dns.AAAA); !ok || aaaa.Hdr.Name != "ns2.example.com." || aaaa.AAAA.String() != "2001:db8::2" {
+		t.Errorf("Glue for ns2 is %s", m.Extra[1])
+	}
+
+	if m := query(d, "ns2.example.com.", dns.TypeAAAA); len(m.Answer) != 1 {
+		t.Error("Nameserver's AAAA wasn't answered")
+	}
+}
+
+func TestMultiLabelNames(t *testing.T) {
+	_, d, _ := testServers(t)
+	if err := d.AddKey(testDnsKey("a.b", "key"), "ab"); err != nil {
+		t.Fatal(err)
+	}
+	d.GetKey("ab").SetOn(true)
+
+	for name, answered := range map[string]bool{
+		"a.b.example.com.":   true,
+		"A.B.EXAMPLE.COM.":   true,
+		"a.b.c.example.com.": false,
+		"x.a.b.example.com.": false,
+		"b.example.com.":     false,
+	} {
+		if m := query(d, name, dns.TypeTXT); (len(m.Answer) == 1) != answered {
+			t.Errorf("%s: %d answers, want answered %v", name, len(m.Answer), answered)
+		}
+	}
+	if relativeName("example.com.", "A.b.Example.com") != "a.b" {
+		t.Error("relativeName doesn't strip the zone")
+	}
+}
+
+func TestTTLSettings(t *testing.T) {
+	_, d, _ := testServers(t)
+	for _, value := range []string{"", "-1", "ten", "4294967296"} {
+		if err := d.SetSetting("NegativeTTL", value); err == nil {
+			t.Errorf("NegativeTTL %q accepted", value)
+		}
+	}
+	if d.Setting("NegativeTTL") != "60" {
+		t.Errorf("NegativeTTL changed to %s", d.Setting("NegativeTTL"))
+	}
+
+	// a bad value from an old state file falls back to the setting's own default
+	d.applySettings(map[string]string{"NegativeTTL": "ten"})
+	if m := query(d, "example.com.", dns.TypeSOA); m.Answer[0].(*dns.SOA).Minttl != 60 {
+		t.Errorf("Invalid NegativeTTL gave a Minttl of %d", m.Answer[0].(*dns.SOA).Minttl)
+	}
+
+	if err := d.SetSetting("NameserverIPs", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetSetting("NameserverIPs", ""); err != nil {
+		t.Errorf("NameserverIPs couldn't be emptied: %s", err)
+	}
+	if err := d.SetSetting("NameserverIPs", "192.0.2.1,nope"); err == nil {
+		t.Error("Invalid NameserverIPs accepted")
+	}
+}
@@ -0,0 +1,121 @@
+package servers
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// hashAlgorithms are the hashes a key can be built with. Stagers only need one
+// of them, so pick whatever the stager's language has available.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha512":   sha512.New,
+	"sha256":   sha256.New,
+	"sha1":     sha1.New,
+	"md5":      md5.New,
+	"sha3-256": sha3.New256,
+	"sha3-512": sha3.New512,
+	"blake2b-256": func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	"blake2b-512": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// hmacAlgorithm is keyed with the key's HmacSecret
+const hmacAlgorithm = "hmac-sha256"
+
+// HashAlgorithms returns the names of all supported hashing algorithms
+func HashAlgorithms() []string {
+	algs := []string{hmacAlgorithm}
+	for alg := range hashAlgorithms {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// addHashKeyData adds the hashing settings shared by HTTP and DNS keys
+func addHashKeyData(data map[string]*KeyData) {
+	data["HashAlgorithms"] = &KeyData{
+		Description: "Comma separated hashes to build: " + strings.Join(HashAlgorithms(), ", "),
+		Value:       "sha512",
+	}
+
+	data["HmacSecret"] = &KeyData{
+		Description: "Secret for the hmac-sha256 hash",
+		Value:       "",
+		Secret:      true,
+	}
+}
+
+// BuildKey takes the string data and generates a hash for each algorithm, the
+// secret is only used by hmac-sha256
+// returns: map of algorithm name to hex encoded hash
+func BuildKey(s string, algorithms []string, secret string) (map[string]string, error) {
+	if len(algorithms) == 0 {
+		return nil, errors.New("No hash algorithms set")
+	}
+
+	hashes := make(map[string]string)
+	for _, alg := range algorithms {
+		alg = strings.ToLower(alg)
+		var h hash.Hash
+		if alg == hmacAlgorithm {
+			if secret == "" {
+				return nil, errors.New("HmacSecret must be set to use " + hmacAlgorithm)
+			}
+			h = hmac.New(sha256.New, []byte(secret))
+		} else if newHash, ok := hashAlgorithms[alg]; ok {
+			h = newHash()
+		} else {
+			return nil, errors.New("Unsupported hash algorithm: " + alg)
+		}
+		h.Write([]byte(s))
+		hashes[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// buildHashes builds the key's hashes from its key material using the key's
+// HashAlgorithms and HmacSecret
+func (k *Key) buildHashes(material string) error {
+	hashes, err := BuildKey(material, splitSetting(k.Data["HashAlgorithms"].Value), k.Data["HmacSecret"].Value)
+	if err != nil {
+		return err
+	}
+	k.Hashes = hashes
+	k.Material = material
+	return nil
+}
+
+// GenerateSHA512 takes a string, generates a SHA512 hash
+// and sends back as hex string
+func GenerateSHA512(s string) string {
+	sha := sha512.New()
+	sha.Write([]byte(s))
+
+	return hex.EncodeToString(sha.Sum(nil))
+}
+
+// GenerateSHA256 takes a string, generates a SHA256 hash
+// and sends back as hex string
+func GenerateSHA256(s string) string {
+	sha := sha256.New()
+	sha.Write([]byte(s))
+
+	return hex.EncodeToString(sha.Sum(nil))
+}
@@ -1,45 +1,69 @@
 package servers
 
 import (
-	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 // Key contains attributes that fit both Http and Dns keys
+//
+// Type, Data, Constraints and Expression are set up before the key is added to a
+// server and are only read afterwards. The on/off/alert state and hit counters
+// change while requests are being served, so they're guarded by mu and
+// accessed through the methods below. Hashes and Material are set up the same
+// way but an HTTP key's are replaced if its file is re-hashed, so use
+// GetHashes and GetMaterial once the key has been added.
 type Key struct {
 	Type        string
-	On          bool
-	Disabled    bool
-	SendAlerts  bool
-	HitCounter  map[string]int
-	LastHit     string
 	Data        map[string]*KeyData
 	Constraints map[string]*KeyConstraint
+	Expression  string
 	Hashes      map[string]string
+	Material    string
+	expr        exprNode
+	hostnameRe  *regexp.Regexp
+
+	mu         sync.RWMutex
+	on         bool
+	disabled   bool
+	sendAlerts bool
+	hitCounter map[string]int
+	lastHit    string
+	content    []byte // HTTP file contents that were hashed, and are served
+	driftSeen  string // fingerprint of the last drift reported, so it's only reported once
 }
 
 type KeyData struct {
 	Description string
 	Value       string
+	Secret      bool // redacted in the audit log
 }
 
 type KeyConstraint struct {
 	Description     string
 	Constraint      string
 	ConstraintRegex *regexp.Regexp
+	Check           func(constraint string) error // optional, for values a regex can't fully validate
+	Request         bool                          // needs the request or query to be checked, see Status
 	HttpValidator   func(constraint string, r *http.Request) bool
-	DnsValidator    func(constraint string, q *dns.Question) bool
+	DnsValidator    func(constraint string, q *DnsQuery) bool
+}
+
+// DnsQuery is what DNS key constraints are evaluated against, the question
+// along with the address of the resolver that sent it
+type DnsQuery struct {
+	Question *dns.Question
+	Source   net.IP
 }
 
 //
@@ -59,6 +83,17 @@ func HttpKeyData() map[string]*KeyData {
 		Value:       "/content/file.html",
 	}
 
+	data["KeySelector"] = &KeyData{
+		Description: "Part of the file used as the key: '#id', 'regex:<pattern>' or 'offset:<start>:<length>'. Empty uses the whole file",
+		Value:       "",
+	}
+
+	data["DriftPolicy"] = &KeyData{
+		Description: "If the file changes on disk: 'pin' keeps serving the original content, 'rehash' serves and re-hashes the new content",
+		Value:       "pin",
+	}
+
+	addHashKeyData(data)
 	return data
 }
 
@@ -87,6 +122,32 @@ func (k *Key) GetHttpKeyConstraints() map[string]*KeyConstraint {
 		HttpValidator:   k.HitMaxHttpConstraint,
 	}
 
+	constraints["IPRange"] = &KeyConstraint{
+		Description:     "Turn on the key for requests from these comma separated CIDRs (uses X-Forwarded-For from the HTTP server's TrustedProxies)",
+		Constraint:      "",
+		ConstraintRegex: regexp.MustCompile("^[0-9a-fA-F:./, ]+$"),
+		Check:           checkIPRanges,
+		HttpValidator:   k.IPRangeHttpConstraint,
+		Request:         true,
+	}
+
+	constraints["UserAgent"] = &KeyConstraint{
+		Description:     "Turn on the key when the User-Agent header matches exactly",
+		Constraint:      "",
+		ConstraintRegex: regexp.MustCompile("^.+$"),
+		HttpValidator:   k.UserAgentHttpConstraint,
+		Request:         true,
+	}
+
+	constraints["Header"] = &KeyConstraint{
+		Description:     "Turn on the key when all headers match: 'Name: regex' pairs separated by ';;'",
+		Constraint:      "",
+		ConstraintRegex: regexp.MustCompile("^[A-Za-z0-9-]+:.*$"),
+		Check:           checkHeaderPatterns,
+		HttpValidator:   k.HeaderHttpConstraint,
+		Request:         true,
+	}
+
 	return constraints
 }
 
@@ -120,8 +181,21 @@ func (k *Key) HitMaxHttpConstraint(constraint string, r *http.Request) bool {
 	return false
 }
 
-// UserAgentConstraint is a key constraint that returns true if the current time falls
-// within a specified timeframe. requestData is null as the data we want is the current time.
+// IPRangeHttpConstraint is a key constraint that returns true if the client's
+// address, as resolved by clientAddress, falls within one of the CIDRs
+func (k *Key) IPRangeHttpConstraint(constraint string, r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	ip, _ := r.Context().Value(clientIPKey{}).(net.IP)
+	if ip == nil {
+		ip = net.ParseIP(remoteHost(r))
+	}
+	return ipRangeConstraint(constraint, ip)
+}
+
+// UserAgentHttpConstraint is a key constraint that returns true if the request's
+// User-Agent header matches the supplied value exactly
 func (k *Key) UserAgentHttpConstraint(constraint string, r *http.Request) bool {
 	if r == nil {
 		return false
@@ -132,27 +206,95 @@ func (k *Key) UserAgentHttpConstraint(constraint string, r *http.Request) bool {
 	return false
 }
 
+// HeaderHttpConstraint is a key constraint that returns true if every 'Name: regex'
+// pair matches the request's header of that name. A missing header is matched as
+// an empty value.
+func (k *Key) HeaderHttpConstraint(constraint string, r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	patterns, err := parseHeaderPatterns(constraint)
+	if err != nil {
+		return false
+	}
+	for _, hp := range patterns {
+		if !hp.regex.MatchString(r.Header.Get(hp.name)) {
+			return false
+		}
+	}
+	return true
+}
+
 // AddKey does the fun stuff, takes in the data generates the hasehs and adds
 // it to the end of the Keys slice within the HttpServer
 func (h *HttpServer) AddKey(k *Key, name string) error {
 	if strings.Contains(name, " ") {
 		return errors.New("Key name contains spaces")
 	}
-	if _, exists := h.Keys[name]; exists {
+	if h.GetKey(name) != nil {
 		return errors.New("Key name already exists!")
 	}
+	if err := h.prepareKey(k); err != nil {
+		return err
+	}
+	return h.insertKey(name, k)
+}
+
+// EditKey validates and hashes k then swaps it in for the key called name,
+// keeping the old key's hit history and on/off/alert state. newName renames
+// the key if it's different.
+// returns: whether the key's hashes changed
+func (h *HttpServer) EditKey(name, newName string, k *Key) (bool, error) {
+	if strings.Contains(newName, " ") {
+		return false, errors.New("Key name contains spaces")
+	}
+	if err := h.prepareKey(k); err != nil {
+		return false, err
+	}
+	old, err := h.replaceKey(name, newName, k)
+	if err != nil {
+		return false, err
+	}
+	return !sameHashes(old.GetHashes(), k.GetHashes()), nil
+}
+
+// CloneKey adds a copy of the key src as dst, see Key.Copy. The copy keeps the
+// alert setting but starts off with no hits and not manually turned on.
+func (h *HttpServer) CloneKey(src, dst string) error {
+	k := h.GetKey(src)
+	if k == nil {
+		return errors.New("Key " + src + " doesn't exist")
+	}
+	c := k.Copy()
+	c.SetSendAlerts(k.AlertsEnabled())
+	return h.AddKey(c, dst)
+}
 
+// prepareKey validates an HTTP key and builds its hashes from its file
+func (h *HttpServer) prepareKey(k *Key) error {
 	if err := validateKeyConstraints(k.Constraints); err != nil {
 		return err
 	}
+	if err := checkExpression(k); err != nil {
+		return err
+	}
+	if policy := k.Data["DriftPolicy"].Value; policy != "pin" && policy != "rehash" {
+		return errors.New("DriftPolicy must be 'pin' or 'rehash'")
+	}
 
-	fileContents, err := ReadFile(k.Data["FilePath"].Value)
+	fileContents, err := h.cache.read(k.Data["FilePath"].Value)
 	if err != nil {
+		return errors.New("Unable to read FilePath: " + err.Error())
+	}
+	material, err := SelectKeyMaterial(string(fileContents), k.Data["KeySelector"].Value)
+	if err != nil {
+		return err
+	}
+	if err := k.buildHashes(material); err != nil {
 		return err
 	}
-	k.Hashes = BuildKey(string(fileContents))
+	k.content = fileContents
 
-	h.Keys[name] = k
 	return nil
 }
 
@@ -164,25 +306,36 @@ func DnsKeyData() map[string]*KeyData {
 	data := make(map[string]*KeyData)
 
 	data["Hostname"] = &KeyData{
-		Description: "The hostname for the DNS request, do not include FQDN",
+		Description: "The hostname for the DNS request relative to Domain, e.g. 'mail' or 'a.b'. Use '@' for Domain itself",
 		Value:       "mail",
 	}
 
+	data["HostnameMatch"] = &KeyData{
+		Description: "How Hostname is matched: 'exact', 'wildcard' ('*' matches one label, e.g. *.cdn) or 'regex'. Captures can be used in Response as $1 or ${name}",
+		Value:       "exact",
+	}
+
 	data["RecordType"] = &KeyData{
-		Description: "The record type: A or TXT",
+		Description: "The record type: A, AAAA, TXT, CNAME, MX, SRV or NS",
 		Value:       "TXT",
 	}
 
 	data["Response"] = &KeyData{
-		Description: "The response to send back for the request.",
+		Description: "The response to send back for the request. MX: '<preference> <host>', SRV: '<priority> <weight> <port> <target>'",
 		Value:       "",
 	}
 
+	data["TXTSplit"] = &KeyData{
+		Description: "How TXT responses over 255 bytes are split: 'strings' (one record) or 'records' (one record per chunk, prefixed with 'N:')",
+		Value:       "strings",
+	}
+
 	data["TTL"] = &KeyData{
 		Description: "The TTL for the DNS response (in seconds). Important to keep smaller than the delay if using retries.",
 		Value:       "180",
 	}
 
+	addHashKeyData(data)
 	return data
 }
 
@@ -210,19 +363,28 @@ func (k *Key) GetDnsKeyConstraints() map[string]*KeyConstraint {
 		DnsValidator:    k.HitMaxDnsConstraint,
 	}
 
+	constraints["IPRange"] = &KeyConstraint{
+		Description:     "Turn on the key for queries from resolvers in these comma separated CIDRs",
+		Constraint:      "",
+		ConstraintRegex: regexp.MustCompile("^[0-9a-fA-F:./, ]+$"),
+		Check:           checkIPRanges,
+		DnsValidator:    k.IPRangeDnsConstraint,
+		Request:         true,
+	}
+
 	return constraints
 
 }
 
 // TimeConstraint is a key constraint that returns true if the current time falls
 // within a specified timeframe. DNS request data not needed as we just want the current time.
-func (k *Key) TimeDnsConstraint(constraint string, q *dns.Question) bool {
+func (k *Key) TimeDnsConstraint(constraint string, q *DnsQuery) bool {
 	return timeConstraint(constraint)
 }
 
 // HitLimitDnsConstraint is a key constraint that returns true if the number of hits
 // is below the supplied limit
-func (k *Key) HitLimitDnsConstraint(constraint string, q *dns.Question) bool {
+func (k *Key) HitLimitDnsConstraint(constraint string, q *DnsQuery) bool {
 	limit, err := strconv.Atoi(constraint)
 	if err == nil {
 		if k.GetHits() < limit {
@@ -234,7 +396,7 @@ func (k *Key) HitLimitDnsConstraint(constraint string, q *dns.Question) bool {
 
 // HitMaxDnsConstraint is a key constraint that returns true if the number of hits
 // is above the supplied value
-func (k *Key) HitMaxDnsConstraint(constraint string, q *dns.Question) bool {
+func (k *Key) HitMaxDnsConstraint(constraint string, q *DnsQuery) bool {
 	value, err := strconv.Atoi(constraint)
 	if err == nil {
 		if k.GetHits() > value {
@@ -244,77 +406,320 @@ func (k *Key) HitMaxDnsConstraint(constraint string, q *dns.Question) bool {
 	return false
 }
 
+// IPRangeDnsConstraint is a key constraint that returns true if the resolver
+// sending the query falls within one of the CIDRs
+func (k *Key) IPRangeDnsConstraint(constraint string, q *DnsQuery) bool {
+	if q == nil {
+		return false
+	}
+	return ipRangeConstraint(constraint, q.Source)
+}
+
 // AddKey does the fun stuff, takes in the data generates the hasehs and adds
 // it to the end of the Keys slice within the HttpServer
 func (d *DnsServer) AddKey(k *Key, name string) error {
 	if strings.Contains(name, " ") {
 		return errors.New("Key name contains spaces")
 	}
-	if _, exists := d.Keys[name]; exists {
+	if d.GetKey(name) != nil {
 		return errors.New("Key name already exists!")
 	}
+	if err := d.prepareKey(k); err != nil {
+		return err
+	}
+	return d.insertKey(name, k)
+}
+
+// EditKey validates and hashes k then swaps it in for the key called name,
+// keeping the old key's hit history and on/off/alert state. newName renames
+// the key if it's different.
+// returns: whether the key's hashes changed
+func (d *DnsServer) EditKey(name, newName string, k *Key) (bool, error) {
+	if strings.Contains(newName, " ") {
+		return false, errors.New("Key name contains spaces")
+	}
+	if err := d.prepareKey(k); err != nil {
+		return false, err
+	}
+	old, err := d.replaceKey(name, newName, k)
+	if err != nil {
+		return false, err
+	}
+	return !sameHashes(old.GetHashes(), k.GetHashes()), nil
+}
+
+// CloneKey adds a copy of the key src as dst, see Key.Copy. The copy keeps the
+// alert setting but starts off with no hits and not manually turned on.
+func (d *DnsServer) CloneKey(src, dst string) error {
+	k := d.GetKey(src)
+	if k == nil {
+		return errors.New("Key " + src + " doesn't exist")
+	}
+	c := k.Copy()
+	c.SetSendAlerts(k.AlertsEnabled())
+	return d.AddKey(c, dst)
+}
 
+// prepareKey validates a DNS key and builds its hashes from its response
+func (d *DnsServer) prepareKey(k *Key) error {
 	if err := validateKeyConstraints(k.Constraints); err != nil {
 		return err
 	}
+	if err := checkExpression(k); err != nil {
+		return err
+	}
 
-	k.Hashes = BuildKey(k.Data["Response"].Value)
+	if err := k.compileHostname(); err != nil {
+		return err
+	}
 
-	// remove unused constraints
-	for name, _ := range k.Constraints {
-		if k.Constraints[name].Constraint == "" {
-			delete(k.Constraints, name)
+	rrtype := recordStringToUint(k.Data["RecordType"].Value)
+	if rrtype == dns.TypeNone {
+		return errors.New("Unsupported record type: " + k.Data["RecordType"].Value)
+	}
+	// responses using captures can only be checked once they're expanded at query time
+	if k.hostnameRe == nil || !strings.Contains(k.Data["Response"].Value, "$") {
+		if _, err := buildRR(rrtype, k.Data["Response"].Value); err != nil {
+			return errors.New("Invalid response for " + k.Data["RecordType"].Value + " record: " + err.Error())
 		}
 	}
-	d.Keys[name] = k
+	if split := k.Data["TXTSplit"].Value; split != "strings" && split != "records" {
+		return errors.New("TXTSplit must be 'strings' or 'records'")
+	}
+
+	if err := k.buildHashes(k.Data["Response"].Value); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// compileHostname prepares the regex used to match wildcard and regex hostnames.
+// Patterns must match the whole hostname and are case insensitive.
+func (k *Key) compileHostname() error {
+	hostname := k.Data["Hostname"].Value
+	switch k.Data["HostnameMatch"].Value {
+	case "exact":
+		k.hostnameRe = nil
+		return nil
+	case "wildcard":
+		labels := strings.Split(hostname, ".")
+		for i, label := range labels {
+			if label == "*" {
+				labels[i] = "([^.]+)"
+			} else {
+				labels[i] = regexp.QuoteMeta(label)
+			}
+		}
+		k.hostnameRe = regexp.MustCompile("(?i)^" + strings.Join(labels, `\.`) + "$")
+		return nil
+	case "regex":
+		re, err := regexp.Compile("(?i)^(?:" + hostname + ")$")
+		if err != nil {
+			return errors.New("Invalid Hostname regex: " + err.Error())
+		}
+		k.hostnameRe = re
+		return nil
+	default:
+		return errors.New("HostnameMatch must be 'exact', 'wildcard' or 'regex'")
+	}
+}
+
+// MatchHostname checks a query's hostname, relative to the DNS server's Domain,
+// against the key. Returns whether it matched and the response with any
+// captures from a wildcard or regex hostname expanded.
+func (k *Key) MatchHostname(hostname string) (bool, string) {
+	if k.hostnameRe == nil {
+		return strings.EqualFold(hostname, k.Data["Hostname"].Value), k.Data["Response"].Value
+	}
+	submatches := k.hostnameRe.FindStringSubmatchIndex(hostname)
+	if submatches == nil {
+		return false, ""
+	}
+	resp := k.hostnameRe.ExpandString(nil, k.Data["Response"].Value, hostname, submatches)
+	return true, string(resp)
+}
+
 //
 // Key functions for HTTP and DNS
 //
 
+// NewKey returns an empty key of the given type ("http" or "dns") with its
+// default data and constraints, or nil if the type is unknown
+func NewKey(keyType string) *Key {
+	k := &Key{
+		Type:       keyType,
+		Hashes:     make(map[string]string),
+		hitCounter: make(map[string]int),
+	}
+	k.hitCounter[GetToday()] = 0
+
+	switch keyType {
+	case "http":
+		k.Data = HttpKeyData()
+		k.Constraints = k.GetHttpKeyConstraints()
+	case "dns":
+		k.Data = DnsKeyData()
+		k.Constraints = k.GetDnsKeyConstraints()
+	default:
+		return nil
+	}
+	return k
+}
+
+// Copy returns a new key with the same Data, Constraints and Expression, with
+// the constraint validators bound to the new key. Hits, on/off/alert state and
+// hashes aren't copied, the copy still needs adding to a server.
+func (k *Key) Copy() *Key {
+	c := NewKey(k.Type)
+	for name, kd := range k.Data {
+		if cd, ok := c.Data[name]; ok {
+			cd.Value = kd.Value
+		}
+	}
+	for name, kc := range k.Constraints {
+		if cc, ok := c.Constraints[name]; ok {
+			cc.Constraint = kc.Constraint
+		}
+	}
+	// the expression was already validated against these constraints
+	c.SetExpression(k.Expression)
+	return c
+}
+
+// takeHistory copies the hit history and on/off/alert state from old, used
+// when a key replaces another
+func (k *Key) takeHistory(old *Key) {
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.on = old.on
+	k.disabled = old.disabled
+	k.sendAlerts = old.sendAlerts
+	k.lastHit = old.lastHit
+	k.hitCounter = make(map[string]int, len(old.hitCounter))
+	for day, hits := range old.hitCounter {
+		k.hitCounter[day] = hits
+	}
+}
+
 // IsActive determines whether a key is active for the HttpServer
 // The string returned is the "reason" the key is active or inactive, manually turned
-// on or due to a constraint
-func (k *Key) IsActive(r *http.Request, q *dns.Question) (bool, string) {
-	if k.Disabled {
+// on or due to a constraint. Constraints are combined using the key's Expression,
+// or if there isn't one the key is active when manually on or any constraint
+// matches, as long as HitLimit hasn't been reached.
+func (k *Key) IsActive(r *http.Request, q *DnsQuery) (bool, string) {
+	if k.IsDisabled() {
 		return false, "disabled"
 	}
 
-	var reasons []string
-	var active bool
-	if k.On {
-		active = true
-		reasons = append(reasons, "Manual")
+	expr := k.expr
+	if expr == nil {
+		expr = defaultExpression(k)
 	}
 
-	for name, _ := range k.Constraints {
-		if k.Type == "http" {
-			if k.Constraints[name].HttpValidator(k.Constraints[name].Constraint, r) {
-				active = true
-				reasons = append(reasons, name)
+	active, reasons := expr.eval(func(name string) bool {
+		return k.matchConstraint(name, r, q)
+	})
+
+	return active, strings.Join(reasons, ", ")
+}
+
+// Key statuses from Status
+const (
+	StatusActive   = "yes"
+	StatusInactive = "no"
+	StatusDepends  = "depends on request"
+)
+
+// Status is IsActive for listing keys, when there's no request. Manual, Time
+// and the hit constraints are checked as they are now. If the result then
+// depends on constraints that need a request it's StatusDepends, with those
+// constraints as the reason.
+func (k *Key) Status() (string, string) {
+	if k.IsDisabled() {
+		return StatusInactive, "disabled"
+	}
+
+	expr := k.expr
+	if expr == nil {
+		expr = defaultExpression(k)
+	}
+
+	var request []string
+	seen := make(map[string]bool)
+	for _, ident := range expr.idents() {
+		if kc, ok := k.Constraints[ident.name]; ok && kc.Request && kc.Constraint != "" && !seen[ident.name] {
+			seen[ident.name] = true
+			request = append(request, ident.name)
+		}
+	}
+
+	// try every combination of the request constraints matching
+	var active, inactive bool
+	var reasons []string
+	for combo := 0; combo < 1<<uint(len(request)); combo++ {
+		matched, r := expr.eval(func(name string) bool {
+			for i, requested := range request {
+				if name == requested {
+					return combo&(1<<uint(i)) != 0
+				}
 			}
-		} else if k.Type == "dns" {
-			if k.Constraints[name].DnsValidator(k.Constraints[name].Constraint, q) {
-				active = true
-				reasons = append(reasons, name)
+			return k.matchConstraint(name, nil, nil)
+		})
+		if matched {
+			active = true
+			if reasons == nil {
+				reasons = r
 			}
-
+		} else {
+			inactive = true
 		}
 	}
 
-	return active, strings.Join(reasons, ", ")
+	switch {
+	case active && inactive:
+		return StatusDepends, strings.Join(request, ", ")
+	case active:
+		return StatusActive, strings.Join(reasons, ", ")
+	}
+	return StatusInactive, ""
+}
+
+// matchConstraint checks a name from the key's expression, r and q are nil
+// for constraints that don't need them
+func (k *Key) matchConstraint(name string, r *http.Request, q *DnsQuery) bool {
+	if name == "Manual" {
+		return k.IsOn()
+	}
+	kc, ok := k.Constraints[name]
+	if !ok || kc.Constraint == "" {
+		return false
+	}
+	if kc.Request && r == nil && q == nil {
+		return false
+	}
+	if k.Type == "http" {
+		return kc.HttpValidator(kc.Constraint, r)
+	} else if k.Type == "dns" {
+		return kc.DnsValidator(kc.Constraint, q)
+	}
+	return false
 }
 
 // timeConstraint is handled by both DNS and HTTP TimeConstraint methods
 func timeConstraint(constraint string) bool {
 	layout := "15:04"
-	startTime, err := time.Parse(layout, strings.Split(constraint, "-")[0])
+	times := strings.Split(constraint, "-")
+	if len(times) != 2 {
+		return false
+	}
+	startTime, err := time.Parse(layout, times[0])
 	if err != nil {
 		return false
 	}
-	endTime, err := time.Parse(layout, strings.Split(constraint, "-")[1])
+	endTime, err := time.Parse(layout, times[1])
 	if err != nil {
 		return false
 	}
@@ -333,69 +738,207 @@ func timeConstraint(constraint string) bool {
 	return false
 }
 
-//
-// Hashing stuff
-//
+// ipRangeConstraint is handled by both DNS and HTTP IPRangeConstraint methods
+func ipRangeConstraint(constraint string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	ranges, err := parseIPRanges(constraint)
+	if err != nil {
+		return false
+	}
+	return inRanges(ranges, ip)
+}
 
-// BuildKey takes the string data and generates all supported hashes
-// A map with the hash type as key and hash as value is returned
-func BuildKey(s string) map[string]string {
-	return map[string]string{
-		"sha512": GenerateSHA512(s),
-		//"sha256": GenerateSHA256(s), - holding off on supporting multiple hashing types for now
+// inRanges returns true if ip is within any of the ranges
+func inRanges(ranges []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
 	}
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPRanges parses a comma separated list of CIDRs, a single IP address
+// is treated as a /32 (or /128 for IPv6)
+func parseIPRanges(constraint string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, cidr := range strings.Split(constraint, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address: " + cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("Invalid CIDR: " + cidr)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("No CIDRs provided")
+	}
+	return ranges, nil
 }
 
-// GenerateSHA512 takes a string, generates a SHA512 hash
-// and sends back as hex string
-func GenerateSHA512(s string) string {
-	sha := sha512.New()
-	sha.Write([]byte(s))
+func checkIPRanges(constraint string) error {
+	_, err := parseIPRanges(constraint)
+	return err
+}
 
-	return hex.EncodeToString(sha.Sum(nil))
+// headerPattern is one 'Name: regex' pair of a Header constraint
+type headerPattern struct {
+	name  string
+	regex *regexp.Regexp
 }
 
-// GenerateSHA256 takes a string, generates a SHA256 hash
-// and sends back as hex string
-func GenerateSHA256(s string) string {
-	sha := sha256.New()
-	sha.Write([]byte(s))
+// parseHeaderPatterns splits a Header constraint into its pairs. Pairs are
+// separated by ';;' as header values such as User-Agent contain single semicolons.
+func parseHeaderPatterns(constraint string) ([]headerPattern, error) {
+	var patterns []headerPattern
+	for _, pair := range strings.Split(constraint, ";;") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("Header must be in the form 'Name: regex': " + pair)
+		}
+		regex, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.New("Invalid regex for header " + parts[0] + ": " + err.Error())
+		}
+		patterns = append(patterns, headerPattern{name: strings.TrimSpace(parts[0]), regex: regex})
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("No headers provided")
+	}
+	return patterns, nil
+}
 
-	return hex.EncodeToString(sha.Sum(nil))
+func checkHeaderPatterns(constraint string) error {
+	_, err := parseHeaderPatterns(constraint)
+	return err
 }
 
 //
 // Helpers
 //
 
-// GetHits returns the hit counter but ensures theres an entry for
-// the current day.
+// GetHits returns the number of hits for the current day
 func (k *Key) GetHits() int {
-	today := GetToday()
-	if _, exists := k.HitCounter[today]; !exists {
-		k.HitCounter[today] = 0
-	}
-	return k.HitCounter[today]
-
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.hitCounter[GetToday()]
 }
 
-// UpdateHits updates the HitCounter for the current day
+// UpdateHits updates the hit counter for the current day
 func (k *Key) UpdateHits() {
-	today := GetToday()
-	if _, exists := k.HitCounter[today]; !exists {
-		k.HitCounter[today] = 0
-	}
-	k.HitCounter[today]++
-	k.LastHit = time.Now().Format("01/02/2006 15:04:05")
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.hitCounter[GetToday()]++
+	k.lastHit = time.Now().Format("01/02/2006 15:04:05")
 }
 
 // ClearHits sets the current day to 0 hits
 func (k *Key) ClearHits() {
-	today := GetToday()
-	if _, exists := k.HitCounter[today]; !exists {
-		k.HitCounter[today] = 0
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.hitCounter[GetToday()] = 0
+}
+
+// HitCounter returns a copy of the hits per day
+func (k *Key) HitCounter() map[string]int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	hits := make(map[string]int, len(k.hitCounter))
+	for day, count := range k.hitCounter {
+		hits[day] = count
+	}
+	return hits
+}
+
+// LastHit returns the time of the last hit, empty if there hasn't been one
+func (k *Key) LastHit() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.lastHit
+}
+
+// IsOn returns whether the key has been manually turned on
+func (k *Key) IsOn() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.on
+}
+
+// SetOn manually turns the key on or off, constraints can still turn it on
+func (k *Key) SetOn(on bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.on = on
+}
+
+// IsDisabled returns whether the key has been disabled
+func (k *Key) IsDisabled() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.disabled
+}
+
+// Disable turns the key off indefinitely, constraints will have no effect
+func (k *Key) Disable() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.on = false
+	k.disabled = true
+}
+
+// AlertsEnabled returns whether hits on this key send alerts
+func (k *Key) AlertsEnabled() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.sendAlerts
+}
+
+// GetHashes returns a copy of the key's hashes
+func (k *Key) GetHashes() map[string]string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	hashes := make(map[string]string, len(k.Hashes))
+	for alg, hash := range k.Hashes {
+		hashes[alg] = hash
 	}
-	k.HitCounter[today] = 0
+	return hashes
+}
+
+// GetMaterial returns the content the key's hashes were built from
+func (k *Key) GetMaterial() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.Material
+}
+
+// SetSendAlerts enables or disables alerting for the key
+func (k *Key) SetSendAlerts(enabled bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.sendAlerts = enabled
 }
 
 func GetToday() string {
@@ -452,6 +995,21 @@ func validateKeyConstraints(constraints map[string]*KeyConstraint) error {
 			e := name + " value is not valid"
 			return errors.New("Key constraint error, " + e)
 		}
+		if kc.Constraint != "" && kc.Check != nil {
+			if err := kc.Check(kc.Constraint); err != nil {
+				return errors.New("Key constraint error, " + name + ": " + err.Error())
+			}
+		}
 	}
 	return nil
 }
+
+// pruneConstraints removes any constraints that were never set so they aren't
+// evaluated by IsActive
+func pruneConstraints(constraints map[string]*KeyConstraint) {
+	for name := range constraints {
+		if constraints[name].Constraint == "" {
+			delete(constraints, name)
+		}
+	}
+}
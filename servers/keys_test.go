@@ -0,0 +1,169 @@
+package servers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestFailedEditKeepsConstraints checks a key being edited in a menu can still
+// have its unset constraints set after the edit's been refused
+func TestFailedEditKeepsConstraints(t *testing.T) {
+	h, d, dir := testServers(t)
+	file := filepath.Join(dir, "file.html")
+	if err := h.AddKey(testHttpKey(file, "/a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddKey(testHttpKey(file, "/b"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.GetKey("a").Constraints["Time"]; ok {
+		t.Error("Unset constraints weren't pruned when the key was added")
+	}
+
+	k := testHttpKey(file, "/a")
+	if _, err := h.EditKey("a", "b", k); err == nil {
+		t.Fatal("Renamed a key over another")
+	}
+	if _, ok := k.Constraints["Time"]; !ok {
+		t.Error("HTTP key's unset constraints pruned by a failed edit")
+	}
+
+	k = testDnsKey("mail", "key")
+	if _, err := d.EditKey("missing", "missing", k); err == nil {
+		t.Fatal("Edited a key that doesn't exist")
+	}
+	if _, ok := k.Constraints["Time"]; !ok {
+		t.Error("DNS key's unset constraints pruned by a failed edit")
+	}
+}
+
+func TestMatchHostname(t *testing.T) {
+	for _, tc := range []struct {
+		match, hostname, response string
+		query                     string
+		want                      bool
+		wantResponse              string
+	}{
+		{"exact", "mail", "key", "mail", true, "key"},
+		{"exact", "mail", "key", "MAIL", true, "key"},
+		{"exact", "mail", "key", "xmail", false, ""},
+		{"wildcard", "*.cdn", "key-$1", "abc.cdn", true, "key-abc"},
+		{"wildcard", "*.cdn", "key-$1", "ABC.CDN", true, "key-ABC"},
+		{"wildcard", "*.cdn", "key", "a.b.cdn", false, ""},
+		{"wildcard", "*.cdn", "key", "abc.cdnx", false, ""},
+		{"wildcard", "*.*.cdn", "$2-$1", "a.b.cdn", true, "b-a"},
+		{"wildcard", "*.*.cdn", "key", "a.cdn", false, ""},
+		{"wildcard", "a*", "key", "abc", false, ""},
+		{"wildcard", "a*", "key", "a*", true, "key"},
+		{"wildcard", "a.b", "key", "axb", false, ""},
+		{"regex", "a*", "key", "aaa", true, "key"},
+		{"regex", "a*", "key", "xa.b", false, ""},
+		{"regex", "a*", "key", "aa.b", false, ""},
+		{"regex", `(?P<id>[0-9]+)\.c2`, "id-${id}", "42.c2", true, "id-42"},
+		{"regex", `[0-9]+\.c2`, "key", "x42.c2", false, ""},
+		{"regex", "a|b", "key", "ab", false, ""},
+	} {
+		k := testDnsKey(tc.hostname, tc.response)
+		k.Data["HostnameMatch"].Value = tc.match
+		if err := k.compileHostname(); err != nil {
+			t.Errorf("%s %q: %s", tc.match, tc.hostname, err)
+			continue
+		}
+		got, resp := k.MatchHostname(tc.query)
+		if got != tc.want || (got && resp != tc.wantResponse) {
+			t.Errorf("%s %q matching %q = %v %q, want %v %q", tc.match, tc.hostname, tc.query, got, resp, tc.want, tc.wantResponse)
+		}
+	}
+}
+
+func TestAddKeyRejectsBadHostnameRegex(t *testing.T) {
+	_, d, _ := testServers(t)
+	k := testDnsKey("(unclosed", "key")
+	k.Data["HostnameMatch"].Value = "regex"
+	if err := d.AddKey(k, "bad"); err == nil {
+		t.Error("Key added with an invalid Hostname regex")
+	}
+	k = testDnsKey("mail", "key")
+	k.Data["HostnameMatch"].Value = "glob"
+	if err := d.AddKey(k, "bad"); err == nil {
+		t.Error("Key added with an unknown HostnameMatch")
+	}
+	if d.GetKey("bad") != nil {
+		t.Error("Rejected key was added to the server")
+	}
+}
+
+func TestCloneKeyIsDeepCopy(t *testing.T) {
+	h, _, dir := testServers(t)
+	if err := h.AddKey(testHttpKey(filepath.Join(dir, "file.html"), "/src"), "src"); err != nil {
+		t.Fatal(err)
+	}
+	src := h.GetKey("src")
+	src.Constraints["HitLimit"].Constraint = "1"
+	src.UpdateHits()
+	src.SetOn(true)
+
+	if err := h.CloneKey("src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	dst := h.GetKey("dst")
+	if dst.GetHits() != 0 || dst.IsOn() {
+		t.Error("Clone took the source's hits or on state")
+	}
+
+	for name, kd := range src.Data {
+		if dst.Data[name] == kd {
+			t.Errorf("Data %s shared with the clone", name)
+		}
+	}
+	for name, kc := range src.Constraints {
+		if dst.Constraints[name] == kc {
+			t.Errorf("Constraint %s shared with the clone", name)
+		}
+	}
+	dst.Data["URL"].Value = "/dst"
+	dst.Constraints["HitLimit"].Constraint = "2"
+	if src.Data["URL"].Value != "/src" || src.Constraints["HitLimit"].Constraint != "1" {
+		t.Error("Changing the clone changed the source")
+	}
+
+	// the clone's validators count its own hits
+	dst.SetOn(true)
+	if active, _ := dst.IsActive(nil, nil); !active {
+		t.Error("Clone is limited by the source's hits")
+	}
+	dst.UpdateHits()
+	dst.UpdateHits()
+	if src.GetHits() != 1 {
+		t.Errorf("Clone's hits counted on the source, %d hits", src.GetHits())
+	}
+	if active, _ := dst.IsActive(nil, nil); active {
+		t.Error("Clone's HitLimit didn't count its own hits")
+	}
+}
+
+func TestEditKeyCopiesHistory(t *testing.T) {
+	h, _, dir := testServers(t)
+	file := filepath.Join(dir, "file.html")
+	if err := h.AddKey(testHttpKey(file, "/a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	old := h.GetKey("a")
+	old.UpdateHits()
+
+	if _, err := h.EditKey("a", "a", testHttpKey(file, "/b")); err != nil {
+		t.Fatal(err)
+	}
+	edited := h.GetKey("a")
+	if edited.GetHits() != 1 {
+		t.Fatalf("Edited key has %d hits, want 1", edited.GetHits())
+	}
+	edited.UpdateHits()
+	if old.GetHits() != 1 {
+		t.Error("Edited key shares its hit history with the key it replaced")
+	}
+	edited.HitCounter()[GetToday()] = 100
+	if edited.GetHits() != 2 {
+		t.Error("HitCounter returned the key's own map")
+	}
+}
@@ -0,0 +1,279 @@
+package servers
+
+// Run with -race, these hammer both servers from several goroutines while
+// keys and settings are changed the way operators change them
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	logging "github.com/op/go-logging"
+)
+
+const raceIterations = 200
+
+func init() {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+}
+
+// testResponseWriter collects the DNS response
+type testResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+// testServers returns both servers with a file for HTTP keys and the
+// DefaultPage in dir
+func testServers(t *testing.T) (*HttpServer, *DnsServer, string) {
+	dir, err := ioutil.TempDir("", "keyserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for _, name := range []string{"file.html", "other.html", "error.html"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("<html>"+name+"</html>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := GetHttpServer()
+	if err := h.SetSetting("DefaultPage", filepath.Join(dir, "error.html")); err != nil {
+		t.Fatal(err)
+	}
+	d := GetDnsServer()
+	if err := d.SetSetting("Domain", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return h, d, dir
+}
+
+func testHttpKey(path, url string) *Key {
+	k := NewKey("http")
+	k.Data["FilePath"].Value = path
+	k.Data["URL"].Value = url
+	k.Constraints["HitLimit"].Constraint = "1000000"
+	return k
+}
+
+func testDnsKey(hostname, response string) *Key {
+	k := NewKey("dns")
+	k.Data["Hostname"].Value = hostname
+	k.Data["Response"].Value = response
+	k.Constraints["HitLimit"].Constraint = "1000000"
+	return k
+}
+
+// hammer runs each function in its own goroutine raceIterations times
+func hammer(fs ...func(i int)) {
+	var wg sync.WaitGroup
+	for _, f := range fs {
+		wg.Add(1)
+		go func(f func(int)) {
+			defer wg.Done()
+			for i := 0; i < raceIterations; i++ {
+				f(i)
+			}
+		}(f)
+	}
+	wg.Wait()
+}
+
+func TestHttpServerConcurrentEdits(t *testing.T) {
+	h, d, dir := testServers(t)
+	file, other := filepath.Join(dir, "file.html"), filepath.Join(dir, "other.html")
+	if err := h.AddKey(testHttpKey(file, "/a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(path string) func(int) {
+		return func(int) {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Body.Len() == 0 {
+				t.Errorf("Empty response for %s", path)
+			}
+		}
+	}
+
+	hammer(
+		request("/a"),
+		request("/b"),
+		request("/missing"),
+		func(i int) {
+			name := "b" + strconv.Itoa(i)
+			if err := h.AddKey(testHttpKey(file, "/b"), name); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := h.EditKey(name, name+"-edited", testHttpKey(other, "/b")); err != nil {
+				t.Error(err)
+			}
+			if err := h.CloneKey(name+"-edited", name+"-clone"); err != nil {
+				t.Error(err)
+			}
+			h.RemoveKey(name + "-edited")
+			h.RemoveKey(name + "-clone")
+		},
+		func(i int) {
+			if k := h.GetKey("a"); k != nil {
+				k.SetOn(i%2 == 0)
+				k.SetSendAlerts(false)
+				k.ClearHits()
+			}
+		},
+		func(i int) {
+			page := file
+			if i%2 == 0 {
+				page = filepath.Join(dir, "error.html")
+			}
+			if err := h.SetSetting("DefaultPage", page); err != nil {
+				t.Error(err)
+			}
+			h.SetSetting("Port", strconv.Itoa(8000+i))
+		},
+		func(int) {
+			TakeSnapshot(h, d)
+			h.Settings()
+		},
+		func(int) {
+			h.CheckKeyFiles()
+		},
+	)
+
+	if n := h.KeyCount(); n != 1 {
+		t.Errorf("Expected only key a to be left, got %d keys", n)
+	}
+}
+
+func TestDnsServerConcurrentEdits(t *testing.T) {
+	h, d, _ := testServers(t)
+	if err := d.AddKey(testDnsKey("a", "key a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, qtype uint16) func(int) {
+		return func(int) {
+			r := new(dns.Msg)
+			r.SetQuestion(name, qtype)
+			w := &testResponseWriter{}
+			d.ServeDNS(w, r)
+			if w.msg == nil {
+				t.Errorf("No response for %s", name)
+			}
+		}
+	}
+
+	hammer(
+		query("a.example.com.", dns.TypeTXT),
+		query("b.example.com.", dns.TypeTXT),
+		query("example.com.", dns.TypeSOA),
+		query("example.com.", dns.TypeNS),
+		query("ns1.example.com.", dns.TypeA),
+		func(i int) {
+			name := "b" + strconv.Itoa(i)
+			if err := d.AddKey(testDnsKey("b", "key b"), name); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := d.EditKey(name, name+"-edited", testDnsKey("b", "key b edited")); err != nil {
+				t.Error(err)
+			}
+			d.RemoveKey(name + "-edited")
+		},
+		func(i int) {
+			if k := d.GetKey("a"); k != nil {
+				k.SetOn(i%2 == 0)
+				k.ClearHits()
+			}
+		},
+		func(i int) {
+			if err := d.SetSetting("DefaultTTL", strconv.Itoa(60+i)); err != nil {
+				t.Error(err)
+			}
+			if err := d.SetSetting("NameserverIPs", "10.0.0."+strconv.Itoa(i%250+1)); err != nil {
+				t.Error(err)
+			}
+			d.UnsetSetting("NegativeTTL")
+			d.SetSetting("Nameservers", "ns1,ns"+strconv.Itoa(i))
+		},
+		func(int) {
+			TakeSnapshot(h, d)
+			d.Settings()
+		},
+	)
+
+	if n := d.KeyCount(); n != 1 {
+		t.Errorf("Expected only key a to be left, got %d keys", n)
+	}
+}
+
+// TestConcurrentStartStop has operators starting and stopping both servers,
+// and changing where they listen, at the same time
+func TestConcurrentStartStop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starting the servers takes a few seconds")
+	}
+	h, d, _ := testServers(t)
+	h.SetSetting("Port", "0")
+	d.SetSetting("Port", "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2; j++ {
+				h.Start()
+				d.Start()
+				h.Stop()
+				d.Stop()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			h.SetSetting("Listen", "127.0.0.1")
+			d.SetSetting("Listen", "127.0.0.1")
+			h.IsRunning()
+			d.IsRunning()
+		}
+	}()
+	wg.Wait()
+
+	h.Stop()
+	d.Stop()
+	if h.IsRunning() || d.IsRunning() {
+		t.Error("Servers still running after being stopped")
+	}
+}
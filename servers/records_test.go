@@ -0,0 +1,173 @@
+package servers
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBuildRR(t *testing.T) {
+	for _, tc := range []struct {
+		rrtype string
+		resp   string
+		want   string // the record's data, empty if it should be rejected
+	}{
+		{"A", "192.0.2.1", "192.0.2.1"},
+		{"A", "2001:db8::1", ""},
+		{"A", "192.0.2", ""},
+		{"A", "", ""},
+		{"AAAA", "2001:db8::1", "2001:db8::1"},
+		{"AAAA", "192.0.2.1", ""},
+		{"AAAA", "::ffff:192.0.2.1", ""},
+		{"CNAME", "target.example.com", "target.example.com."},
+		{"CNAME", "target.example.com.", "target.example.com."},
+		{"CNAME", "bad..name", ""},
+		{"CNAME", "", ""},
+		{"NS", "ns1.example.com", "ns1.example.com."},
+		{"NS", "bad..name", ""},
+		{"MX", "10 mail.example.com", "10 mail.example.com."},
+		{"MX", "mail.example.com", ""},
+		{"MX", "70000 mail.example.com", ""},
+		{"MX", "10 bad..name", ""},
+		{"SRV", "10 20 443 host.example.com", "10 20 443 host.example.com."},
+		{"SRV", "10 20 host.example.com", ""},
+		{"SRV", "10 20 99999 host.example.com", ""},
+		{"SRV", "a 20 443 host.example.com", ""},
+		{"TXT", "v=spf1 -all", "\"v=spf1 -all\""},
+		{"TXT", "", "\"\""},
+	} {
+		rrtype := recordStringToUint(tc.rrtype)
+		rr, err := buildRR(rrtype, tc.resp)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s %q accepted", tc.rrtype, tc.resp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %s", tc.rrtype, tc.resp, err)
+			continue
+		}
+		rr.Header().Rrtype = rrtype
+		if got := rr.String()[len(rr.Header().String()):]; got != tc.want {
+			t.Errorf("%s %q built %q, want %q", tc.rrtype, tc.resp, got, tc.want)
+		}
+	}
+
+	for record, want := range map[string]uint16{"txt": dns.TypeTXT, "Mx": dns.TypeMX, "PTR": dns.TypeNone, "": dns.TypeNone} {
+		if got := recordStringToUint(record); got != want {
+			t.Errorf("recordStringToUint(%q) = %d, want %d", record, got, want)
+		}
+	}
+	if _, err := buildRR(dns.TypePTR, "host.example.com"); err == nil {
+		t.Error("Unsupported record type accepted")
+	}
+}
+
+func TestAddKeyValidatesResponse(t *testing.T) {
+	_, d, _ := testServers(t)
+	k := testDnsKey("mail", "not an ip")
+	k.Data["RecordType"].Value = "A"
+	if err := d.AddKey(k, "mail"); err == nil {
+		t.Error("A key added with a response that isn't an IP")
+	}
+	k = testDnsKey("mail", "192.0.2.1")
+	k.Data["RecordType"].Value = "PTR"
+	if err := d.AddKey(k, "mail"); err == nil {
+		t.Error("Key added with an unsupported record type")
+	}
+}
+
+func TestSplitTXT(t *testing.T) {
+	for n, want := range map[int][]int{
+		0:   {0},
+		255: {255},
+		256: {255, 1},
+		510: {255, 255},
+		511: {255, 255, 1},
+	} {
+		chunks := splitTXT(strings.Repeat("a", n), maxTXTString)
+		var sizes []int
+		for _, c := range chunks {
+			sizes = append(sizes, len(c))
+		}
+		if !reflect.DeepEqual(sizes, want) {
+			t.Errorf("splitTXT of %d bytes gave chunks of %v, want %v", n, sizes, want)
+		}
+	}
+}
+
+func TestSplitTXTRecords(t *testing.T) {
+	// "0:" to "9:" leave 253 bytes, "10:" onwards 252
+	for n, want := range map[int]int{0: 1, 253: 1, 254: 2, 2530: 10, 2531: 11, 2782: 11, 2783: 12} {
+		resp := strings.Repeat("a", n)
+		chunks := splitTXTRecords(resp)
+		if len(chunks) != want {
+			t.Errorf("%d bytes split into %d records, want %d", n, len(chunks), want)
+		}
+		if strings.Join(chunks, "") != resp {
+			t.Errorf("%d bytes don't join back together", n)
+		}
+		for i, c := range chunks {
+			if l := len(strconv.Itoa(i) + ":" + c); l > maxTXTString {
+				t.Errorf("%d bytes: record %d is %d bytes with its prefix", n, i, l)
+			}
+		}
+	}
+}
+
+// TestReassembleTXTRecords puts the records back together the way stagers do,
+// as resolvers are free to reorder them
+func TestReassembleTXTRecords(t *testing.T) {
+	var b strings.Builder
+	for i := 0; b.Len() < 4000; i++ {
+		b.WriteString(strconv.Itoa(i) + ",")
+	}
+	resp := b.String()
+
+	k := testDnsKey("mail", resp)
+	k.Data["TXTSplit"].Value = "records"
+	rrs, err := keyRecords(dns.TypeTXT, k, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+
+	chunks := map[int]string{}
+	var indexes []int
+	for _, rr := range rrs {
+		txt := rr.(*dns.TXT).Txt
+		if len(txt) != 1 || len(txt[0]) > maxTXTString {
+			t.Fatalf("Record isn't a single character-string: %v", txt)
+		}
+		parts := strings.SplitN(txt[0], ":", 2)
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			t.Fatalf("Record without an index: %q", txt[0])
+		}
+		chunks[i] = parts[1]
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var joined strings.Builder
+	for _, i := range indexes {
+		joined.WriteString(chunks[i])
+	}
+	if joined.String() != resp {
+		t.Error("Reassembled records don't match the response")
+	}
+
+	k.Data["TXTSplit"].Value = "strings"
+	rrs, err = keyRecords(dns.TypeTXT, k, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || strings.Join(rrs[0].(*dns.TXT).Txt, "") != resp {
+		t.Error("Strings in one record don't join back into the response")
+	}
+}
@@ -0,0 +1,157 @@
+package servers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+//
+// Key selectors pick the part of an HTTP key's file that's used as the key,
+// so the rest of the page can carry innocent content. Selectors are:
+//   #id                    inner content of the element with that id
+//   regex:<pattern>        first capture group, or the whole match without one
+//   offset:<start>:<len>   bytes from start, to the end of the file if len is 0
+// The material is taken from the file as-is so stagers can do the same on
+// the page they download.
+//
+
+// SelectKeyMaterial applies the selector to content, an empty selector uses
+// the whole content
+func SelectKeyMaterial(content, selector string) (string, error) {
+	switch {
+	case selector == "":
+		return content, nil
+	case strings.HasPrefix(selector, "#"):
+		return selectElement(content, selector[1:])
+	case strings.HasPrefix(selector, "regex:"):
+		return selectRegex(content, strings.TrimPrefix(selector, "regex:"))
+	case strings.HasPrefix(selector, "offset:"):
+		return selectOffset(content, strings.TrimPrefix(selector, "offset:"))
+	default:
+		return "", errors.New("KeySelector must be '#id', 'regex:<pattern>' or 'offset:<start>:<length>'")
+	}
+}
+
+// selectElement returns the raw content between the start and end tags of the
+// element with the given id. Only tags with the element's own name change the
+// depth, as elements like <p> and <li> inside it don't need an end tag
+func selectElement(content, id string) (string, error) {
+	if id == "" {
+		return "", errors.New("KeySelector is missing the element id")
+	}
+
+	z := html.NewTokenizer(strings.NewReader(content))
+	var material bytes.Buffer
+	var tag string
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				break
+			}
+			return "", z.Err()
+		}
+		// copy before TagName, which lowercases the tag name in place
+		raw := append([]byte(nil), z.Raw()...)
+
+		if depth == 0 {
+			if tt == html.StartTagToken {
+				name, _ := z.TagName()
+				if tokenHasID(z, id) {
+					tag = string(name)
+					if voidElements[tag] {
+						return "", errors.New("Element with id '" + id + "' is a <" + tag + "> which has no content")
+					}
+					depth = 1
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == tag {
+				depth++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == tag {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return material.String(), nil
+		}
+		material.Write(raw)
+	}
+
+	if depth > 0 {
+		return "", errors.New("Element with id '" + id + "' is never closed")
+	}
+	return "", errors.New("No element with id '" + id + "' found")
+}
+
+// voidElements never have an end tag so can't be selected
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// tokenHasID checks the current tag token's id attribute, this consumes the
+// token's attributes
+func tokenHasID(z *html.Tokenizer, id string) bool {
+	for {
+		key, val, more := z.TagAttr()
+		if string(key) == "id" && string(val) == id {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+func selectRegex(content, pattern string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", errors.New("Invalid KeySelector regex: " + err.Error())
+	}
+	match := re.FindStringSubmatch(content)
+	if match == nil {
+		return "", errors.New("KeySelector regex doesn't match the file")
+	}
+	if len(match) > 1 {
+		return match[1], nil
+	}
+	return match[0], nil
+}
+
+func selectOffset(content, offset string) (string, error) {
+	parts := strings.Split(offset, ":")
+	if len(parts) != 2 {
+		return "", errors.New("KeySelector offset must be 'offset:<start>:<length>'")
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 {
+		return "", errors.New("KeySelector offset start is not a valid number")
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil || length < 0 {
+		return "", errors.New("KeySelector offset length is not a valid number")
+	}
+
+	end := len(content)
+	if length > 0 {
+		end = start + length
+	}
+	if start >= len(content) || end > len(content) {
+		return "", errors.New("KeySelector offset is past the end of the file (" + strconv.Itoa(len(content)) + " bytes)")
+	}
+	return content[start:end], nil
+}
@@ -0,0 +1,77 @@
+package servers
+
+import "testing"
+
+func TestSelectElement(t *testing.T) {
+	for _, tc := range []struct {
+		content, selector, want string
+	}{
+		{`<div id="k">abc</div>`, "#k", "abc"},
+		{`<p>x</p><div id="k">a<b>b</b>c</div><p>y</p>`, "#k", "a<b>b</b>c"},
+		{`<div id="k">a<div>b</div>c</div>`, "#k", "a<div>b</div>c"},
+		{`<div id="k">a<br>b<img src="x">c</div>`, "#k", `a<br>b<img src="x">c`},
+		// <p> and <li> don't need an end tag
+		{`<div id="k"><p>one<p>two</div><p>after`, "#k", "<p>one<p>two"},
+		{`<ul id="k"><li>one<li>two</ul>`, "#k", "<li>one<li>two"},
+		{`<DIV ID="k">abc</Div>`, "#k", "abc"},
+		{`<div class="k" id="k">abc</div>`, "#k", "abc"},
+	} {
+		got, err := SelectKeyMaterial(tc.content, tc.selector)
+		if err != nil {
+			t.Errorf("SelectKeyMaterial(%q, %q): %s", tc.content, tc.selector, err)
+		} else if got != tc.want {
+			t.Errorf("SelectKeyMaterial(%q, %q) = %q, want %q", tc.content, tc.selector, got, tc.want)
+		}
+	}
+
+	for _, content := range []string{
+		`<div id="other">abc</div>`,
+		`<img id="k">`,
+		`<div id="k">abc`,
+		`<p id="k">one<p>two`,
+	} {
+		if got, err := SelectKeyMaterial(content, "#k"); err == nil {
+			t.Errorf("SelectKeyMaterial(%q, #k) = %q, want an error", content, got)
+		}
+	}
+	if _, err := SelectKeyMaterial("<div></div>", "#"); err == nil {
+		t.Error("Selector without an id accepted")
+	}
+}
+
+func TestSelectRegexAndOffset(t *testing.T) {
+	content := "<html>key=abc123;</html>"
+	for _, tc := range []struct {
+		selector, want string
+	}{
+		{"", content},
+		{"regex:key=([a-z0-9]+)", "abc123"},
+		{"regex:key=[a-z0-9]+", "key=abc123"},
+		{"offset:10:6", "abc123"},
+		{"offset:0:6", "<html>"},
+		{"offset:17:0", "</html>"},
+	} {
+		got, err := SelectKeyMaterial(content, tc.selector)
+		if err != nil {
+			t.Errorf("SelectKeyMaterial(%q): %s", tc.selector, err)
+		} else if got != tc.want {
+			t.Errorf("SelectKeyMaterial(%q) = %q, want %q", tc.selector, got, tc.want)
+		}
+	}
+
+	for _, selector := range []string{
+		"regex:(",
+		"regex:missing",
+		"offset:10",
+		"offset:a:1",
+		"offset:-1:1",
+		"offset:0:-1",
+		"offset:24:0",
+		"offset:20:5",
+		"class:k",
+	} {
+		if got, err := SelectKeyMaterial(content, selector); err == nil {
+			t.Errorf("SelectKeyMaterial(%q) = %q, want an error", selector, got)
+		}
+	}
+}
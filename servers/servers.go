@@ -4,8 +4,14 @@ package servers
 // See https://www.youtube.com/watch?v=FeH2Yrw68f8
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -28,23 +34,48 @@ type ServerSetting struct {
 // "DefaultPage":  default page returned with no key matchings
 // "ServerHeader": option HTTP response 'Server' header
 type HttpServer struct {
-	Server  *http.Server
-	State   map[string]*ServerSetting
-	Keys    map[string]*Key
-	Running bool
+	keyRing
+	runFlag
+	settingStore
+	Server   *http.Server // only touched while starting or stopping
+	OnChange func()
+	OnHit    func()
+	cache    *contentCache
 }
 
 // DnsServer struct, uses following map keys for modifiable settings
-// "Listen":     listening IP address
-// "Domain":     the root level domain name we're authoratative over
-// "DefaultTTL": default Time To Live (TTL) for DNS responses
+// "Listen":        listening IP address
+// "Domain":        the root level domain name we're authoratative over
+// "DefaultTTL":    default Time To Live (TTL) for DNS responses
+// "Nameservers":   nameserver hostnames returned for NS queries
+// "NameserverIPs": glue IPs for the nameservers
+// "NegativeTTL":   how long resolvers should cache negative responses
 type DnsServer struct {
-	State      map[string]*ServerSetting
-	Server     *dns.Server
-	Keys       map[string]*Key
-	DefaultTTL uint
-	Running    bool
+	keyRing
+	runFlag
+	settingStore
+	UdpServer  *dns.Server // only touched while starting or stopping
+	TcpServer  *dns.Server
 	SendingKey bool
+	OnChange   func()
+	OnHit      func()
+	serial     uint32 // read by queries, so accessed atomically
+}
+
+// keyRing holds a server's keys. The map is read by every request goroutine
+// while the CLI adds and removes keys, so all access goes through these methods.
+type keyRing struct {
+	mu   sync.RWMutex
+	keys map[string]*Key
+}
+
+// runFlag tracks whether a server is running, it's cleared from the
+// server's goroutine when it exits. Starting and stopping hold lifecycle so
+// two operators can't start or stop the same server at once.
+type runFlag struct {
+	mu        sync.RWMutex
+	running   bool
+	lifecycle sync.Mutex
 }
 
 //
@@ -92,45 +123,89 @@ func GetHttpServer() *HttpServer {
 		Help:     "The default page to send for non-key requests. If empty, '404 Not Found' will be returned.",
 	}
 
+	state["TrustedProxies"] = &ServerSetting{
+		Value:    "",
+		Default:  "",
+		Required: false,
+		Help:     "Comma separated IPs or CIDRs of your redirectors. X-Forwarded-For is only used for requests from these, otherwise it's ignored.",
+	}
+
 	return &HttpServer{
-		State:   state,
-		Running: false,
-		Keys:    make(map[string]*Key),
+		keyRing:      keyRing{keys: make(map[string]*Key)},
+		settingStore: settingStore{State: state},
+		cache:        newContentCache(),
+	}
+}
+
+// Changed is called whenever keys or settings are modified and notifies
+// OnChange if one is set
+func (h *HttpServer) Changed() {
+	if h.OnChange != nil {
+		h.OnChange()
 	}
 }
 
-// StartHTTP is the exported function to call and get
-// the HTTP server running.
-func (h *HttpServer) StartHTTP() {
+// hit is called from requests whenever a key's hit counter changes and
+// notifies OnHit if one is set
+func (h *HttpServer) hit() {
+	if h.OnHit != nil {
+		h.OnHit()
+	}
+}
+
+// startHTTP gets the HTTP server running in the background, as HTTPS if
+// certPath and keyPath are set
+func (h *HttpServer) startHTTP(certPath, keyPath string) {
 	mux := http.NewServeMux()
 	mux.Handle("/", h)
 
-	addr := h.State["Listen"].Value + ":" + h.State["Port"].Value
-	// see net/http docs, this is where to set TLS up as well
-	h.Server = &http.Server{Addr: addr, Handler: mux}
-	h.Running = true
+	addr := h.Setting("Listen") + ":" + h.Setting("Port")
+	server := &http.Server{Addr: addr, Handler: mux}
+	h.Server = server
+	h.setRunning(true)
 
 	go func() {
-		if err := h.Server.ListenAndServe(); err != nil {
-			h.Running = false
+		var err error
+		if certPath != "" && keyPath != "" {
+			err = server.ListenAndServeTLS(certPath, keyPath)
+		} else {
+			err = server.ListenAndServe()
+		}
+		// once it's been shut down the server may already have been restarted
+		if err != nil && err != http.ErrServerClosed {
+			h.setRunning(false)
 		}
 	}()
 }
 
-// StartHTTPS is the exported function to call and get
-// the HTTPS/TLS server running.
-func (h *HttpServer) StartHTTPS() {
-	mux := http.NewServeMux()
-	mux.Handle("/", h)
+// Start starts the HTTP server, as HTTPS if CertPath and KeyPath are set,
+// and waits a second to see whether it stayed up
+func (h *HttpServer) Start() error {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+	if h.IsRunning() {
+		return errors.New("HTTP server already running")
+	}
+	h.startHTTP(h.Setting("CertPath"), h.Setting("KeyPath"))
+	time.Sleep(1 * time.Second)
+	if !h.IsRunning() {
+		return errors.New("Error occurred starting the HTTP server, port already in use?")
+	}
+	return nil
+}
 
-	addr := h.State["Listen"].Value + ":" + h.State["Port"].Value
-	h.Server = &http.Server{Addr: addr, Handler: mux}
-	h.Running = true
-	go func() {
-		if err := h.Server.ListenAndServeTLS(h.State["CertPath"].Value, h.State["CertPath"].Value); err != nil {
-			h.Running = false
-		}
-	}()
+// Stop gracefully shuts down the HTTP server if it's running
+func (h *HttpServer) Stop() error {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+	if !h.IsRunning() {
+		return errors.New("HTTP server isn't running")
+	}
+	if err := h.Server.Shutdown(context.Background()); err != nil {
+		return err
+	}
+	h.setRunning(false)
+	return nil
 }
 
 // GetDnsServer returns a starting point for the DnsServer and
@@ -167,24 +242,231 @@ func GetDnsServer() *DnsServer {
 		Help:     "The default TTL response for DNS queries",
 	}
 
+	state["Nameservers"] = &ServerSetting{
+		Value:    "ns1,ns2",
+		Default:  "ns1,ns2",
+		Required: true,
+		Help:     "Comma separated nameserver hostnames for NS and SOA responses. Names without a dot are within Domain, e.g. ns1 is ns1.domain.com",
+	}
+
+	state["NameserverIPs"] = &ServerSetting{
+		Value:    "",
+		Default:  "",
+		Required: false,
+		Help:     "Comma separated glue IPs for the nameservers, in the same order as Nameservers. Only used for nameservers within Domain",
+	}
+
+	state["NegativeTTL"] = &ServerSetting{
+		Value:    "60",
+		Default:  "60",
+		Required: true,
+		Help:     "The SOA minimum TTL, how long resolvers cache NXDomain and no data responses. Keep small so keys turned on are seen quickly",
+	}
+
 	return &DnsServer{
-		DefaultTTL: 10800,
-		State:      state,
-		Keys:       make(map[string]*Key),
-		Running:    false,
+		keyRing:      keyRing{keys: make(map[string]*Key)},
+		settingStore: settingStore{State: state},
 	}
 }
 
-// StartDNS starts the DNS server in the background
-func (d *DnsServer) StartDNS() {
-	addr := d.State["Listen"].Value + ":" + d.State["Port"].Value
-	d.Server = &dns.Server{Addr: addr, Net: "udp", Handler: d}
-	d.Running = true
-	go func() {
-		if err := d.Server.ListenAndServe(); err != nil {
-			d.Running = false
+// Changed is called whenever keys or settings are modified and notifies
+// OnChange if one is set
+func (d *DnsServer) Changed() {
+	if d.OnChange != nil {
+		d.OnChange()
+	}
+}
+
+// hit is called from queries whenever a key's hit counter changes and
+// notifies OnHit if one is set
+func (d *DnsServer) hit() {
+	if d.OnHit != nil {
+		d.OnHit()
+	}
+}
+
+// startDNS starts the DNS server in the background, listening on both UDP and
+// TCP. Answers too large for UDP are sent with the TC bit set and resolvers
+// retry over TCP. If either listener fails the other is shut down as well so
+// the server is only considered running when both are up.
+func (d *DnsServer) startDNS() {
+	addr := d.Setting("Listen") + ":" + d.Setting("Port")
+	udp := &dns.Server{Addr: addr, Net: "udp", Handler: d}
+	tcp := &dns.Server{Addr: addr, Net: "tcp", Handler: d}
+	d.UdpServer, d.TcpServer = udp, tcp
+	atomic.StoreUint32(&d.serial, uint32(time.Now().Unix()))
+	d.setRunning(true)
+
+	for _, server := range []*dns.Server{udp, tcp} {
+		// the other listener may have already failed by the time this one starts
+		server.NotifyStartedFunc = func(server *dns.Server) func() {
+			return func() {
+				if !d.IsRunning() {
+					go server.Shutdown()
+				}
+			}
+		}(server)
+
+		go func(server *dns.Server) {
+			if err := server.ListenAndServe(); err != nil {
+				d.setRunning(false)
+				shutdownListeners(udp, tcp)
+			}
+		}(server)
+	}
+}
+
+// Start starts the DNS server and waits a second to see whether both
+// listeners stayed up
+func (d *DnsServer) Start() error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+	if d.IsRunning() {
+		return errors.New("DNS server already running")
+	}
+	if d.Setting("Domain") == "" {
+		return errors.New("Set the Domain the DNS server is authoritative for first")
+	}
+	d.startDNS()
+	time.Sleep(1 * time.Second)
+	if !d.IsRunning() {
+		return errors.New("Error occurred starting the DNS server, port already in use?")
+	}
+	return nil
+}
+
+// Stop gracefully shuts down both the UDP and TCP DNS servers if they're running
+func (d *DnsServer) Stop() error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+	if !d.IsRunning() {
+		return errors.New("DNS server isn't running")
+	}
+	if err := shutdownListeners(d.UdpServer, d.TcpServer); err != nil {
+		return err
+	}
+	d.setRunning(false)
+	return nil
+}
+
+// shutdownListeners shuts down both listeners, returning the first error
+func shutdownListeners(udp, tcp *dns.Server) error {
+	udpErr := udp.Shutdown()
+	tcpErr := tcp.Shutdown()
+	if udpErr != nil {
+		return udpErr
+	}
+	return tcpErr
+}
+
+//
+// Key ring functions for HTTP and DNS
+//
+
+// GetKey returns the key with the exact name, or nil if it doesn't exist
+func (kr *keyRing) GetKey(name string) *Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[name]
+}
+
+// FindKey searches for a key name case insensitively and returns the
+// key's actual name, or an empty string if not found
+func (kr *keyRing) FindKey(name string) string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for k := range kr.keys {
+		if strings.ToLower(k) == strings.ToLower(name) {
+			return k
 		}
-	}()
+	}
+	return ""
+}
+
+// Keys returns a copy of the key map which is safe to range over while
+// keys are added or removed
+func (kr *keyRing) Keys() map[string]*Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := make(map[string]*Key, len(kr.keys))
+	for name, k := range kr.keys {
+		keys[name] = k
+	}
+	return keys
+}
+
+// KeyCount returns the number of keys
+func (kr *keyRing) KeyCount() int {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return len(kr.keys)
+}
+
+// RemoveKey deletes a key by name, returning false if it didn't exist
+func (kr *keyRing) RemoveKey(name string) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, exists := kr.keys[name]; !exists {
+		return false
+	}
+	delete(kr.keys, name)
+	return true
+}
+
+// insertKey adds a key, failing if the name is already taken. The check and
+// insert happen under one lock so two callers can't add the same name. Unset
+// constraints are only pruned once nothing can fail, as the key is still
+// being edited in a menu until it's been added.
+func (kr *keyRing) insertKey(name string, k *Key) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, exists := kr.keys[name]; exists {
+		return errors.New("Key name already exists!")
+	}
+	pruneConstraints(k.Constraints)
+	kr.keys[name] = k
+	return nil
+}
+
+// replaceKey swaps k in for the key called name, under newName which may be
+// the same. The old key's hit history moves over to k while the lock is held,
+// so new requests can't find the old key once it's been copied.
+// returns: the key that was replaced
+func (kr *keyRing) replaceKey(name, newName string, k *Key) (*Key, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	old, exists := kr.keys[name]
+	if !exists {
+		return nil, errors.New("Key " + name + " doesn't exist")
+	}
+	if _, taken := kr.keys[newName]; taken && newName != name {
+		return nil, errors.New("Key name already exists!")
+	}
+	k.takeHistory(old)
+	pruneConstraints(k.Constraints)
+	delete(kr.keys, name)
+	kr.keys[newName] = k
+	return old, nil
+}
+
+// putKey adds a key, replacing any key with the same name
+func (kr *keyRing) putKey(name string, k *Key) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[name] = k
+}
+
+// IsRunning returns whether the server is currently running
+func (rf *runFlag) IsRunning() bool {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return rf.running
+}
+
+func (rf *runFlag) setRunning(running bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.running = running
 }
 
 // AlphabetizeSettings takes in a map of ServerSettings and returns
@@ -0,0 +1,76 @@
+package servers
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// freePort finds a port that's free for both UDP and TCP on loopback
+func freePort(t *testing.T) string {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		u, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(port))
+		l.Close()
+		if err == nil {
+			u.Close()
+			return strconv.Itoa(port)
+		}
+	}
+	t.Fatal("No free port for UDP and TCP")
+	return ""
+}
+
+func TestTruncatedOverUDPAndFullOverTCP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starting the server takes a second")
+	}
+	_, d, _ := testServers(t)
+	port := freePort(t)
+	d.SetSetting("Listen", "127.0.0.1")
+	d.SetSetting("Port", port)
+
+	resp := strings.Repeat("0123456789", 200)
+	if err := d.AddKey(testDnsKey("big", resp), "big"); err != nil {
+		t.Fatal(err)
+	}
+	d.GetKey("big").SetOn(true)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	exchange := func(network string, udpSize uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("big.example.com.", dns.TypeTXT)
+		if udpSize > 0 {
+			m.SetEdns0(udpSize, false)
+		}
+		c := &dns.Client{Net: network}
+		r, _, err := c.Exchange(m, "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatalf("%s query: %s", network, err)
+		}
+		return r
+	}
+	full := func(r *dns.Msg) bool {
+		return len(r.Answer) == 1 && strings.Join(r.Answer[0].(*dns.TXT).Txt, "") == resp
+	}
+
+	if r := exchange("udp", 0); !r.Truncated || full(r) {
+		t.Errorf("UDP answer of %d bytes wasn't truncated: TC %v", len(resp), r.Truncated)
+	}
+	if r := exchange("tcp", 0); r.Truncated || !full(r) {
+		t.Error("TCP answer wasn't complete")
+	}
+	if r := exchange("udp", 4096); r.Truncated || !full(r) {
+		t.Error("UDP answer within the EDNS0 size wasn't complete")
+	}
+}
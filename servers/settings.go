@@ -0,0 +1,165 @@
+package servers
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// settingStore holds a server's settings. The values are read by request
+// goroutines while operators change them, so once the server's been created
+// they're only read and written through these methods. Everything else about
+// a setting, and the map itself, never changes.
+type settingStore struct {
+	settingsMu sync.RWMutex
+	State      map[string]*ServerSetting
+}
+
+// Setting returns the value of the setting with the exact name
+func (s *settingStore) Setting(name string) string {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	if setting, ok := s.State[name]; ok {
+		return setting.Value
+	}
+	return ""
+}
+
+// Settings returns a copy of the settings which is safe to read while
+// they're being changed
+func (s *settingStore) Settings() map[string]*ServerSetting {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	settings := make(map[string]*ServerSetting, len(s.State))
+	for name, setting := range s.State {
+		copied := *setting
+		settings[name] = &copied
+	}
+	return settings
+}
+
+// SettingValues returns a copy of each setting's value, for saving or
+// comparing before and after a change
+func (s *settingStore) SettingValues() map[string]string {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	values := make(map[string]string, len(s.State))
+	for name, setting := range s.State {
+		values[name] = setting.Value
+	}
+	return values
+}
+
+func (s *settingStore) setSetting(name, value string) {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	s.State[name].Value = value
+}
+
+// applySettings sets the values of any known settings, unknown settings are
+// ignored
+func (s *settingStore) applySettings(values map[string]string) {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	for name, value := range values {
+		if setting, ok := s.State[name]; ok {
+			setting.Value = value
+		}
+	}
+}
+
+// SetSetting validates and changes a HTTP server setting, the name is case
+// insensitive. Callers should call Changed afterwards.
+func (h *HttpServer) SetSetting(name, value string) error {
+	found := findSetting(h.State, name)
+	if found == "" {
+		return errors.New("Server setting does not exist: " + name)
+	}
+
+	switch found {
+	case "CertPath", "KeyPath":
+		if _, err := os.Stat(value); err != nil {
+			return errors.New("Error reading file: " + err.Error())
+		}
+	case "TrustedProxies":
+		if err := checkIPRanges(value); err != nil {
+			return err
+		}
+	case "DefaultPage":
+		if value != "" {
+			if _, err := h.cache.read(value); err != nil {
+				return errors.New("Error reading file: " + err.Error())
+			}
+		}
+	}
+	h.setSetting(found, value)
+	return nil
+}
+
+// UnsetSetting puts a HTTP server setting back to its default
+func (h *HttpServer) UnsetSetting(name string) error {
+	found := findSetting(h.State, name)
+	if found == "" {
+		return errors.New("Server setting does not exist: " + name)
+	}
+	h.setSetting(found, h.State[found].Default)
+	return nil
+}
+
+// SetSetting validates and changes a DNS server setting, the name is case
+// insensitive. Callers should call Changed afterwards.
+func (d *DnsServer) SetSetting(name, value string) error {
+	found := findSetting(d.State, name)
+	if found == "" {
+		return errors.New("Server setting does not exist: " + name)
+	}
+
+	switch found {
+	case "DefaultTTL", "NegativeTTL":
+		if _, err := parseTTL(value); err != nil {
+			return err
+		}
+	case "NameserverIPs":
+		// empty is fine, there's no glue
+		for _, ip := range splitSetting(value) {
+			if net.ParseIP(ip) == nil {
+				return errors.New(ip + " is not a valid IP address")
+			}
+		}
+	}
+	d.setSetting(found, value)
+	return nil
+}
+
+// UnsetSetting puts a DNS server setting back to its default
+func (d *DnsServer) UnsetSetting(name string) error {
+	found := findSetting(d.State, name)
+	if found == "" {
+		return errors.New("Server setting does not exist: " + name)
+	}
+	d.setSetting(found, d.State[found].Default)
+	return nil
+}
+
+// findSetting returns the actual name of a setting matched case
+// insensitively, or an empty string if there isn't one
+func findSetting(settings map[string]*ServerSetting, name string) string {
+	for k := range settings {
+		if strings.ToLower(k) == strings.ToLower(name) {
+			return k
+		}
+	}
+	return ""
+}
+
+// parseTTL converts a TTL setting value to a uint
+func parseTTL(value string) (uint, error) {
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, errors.New("TTL is not a valid number: " + value)
+	}
+	return uint(ttl), nil
+}
@@ -0,0 +1,281 @@
+package servers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leoloobeek/keyserver/logger"
+)
+
+// StateStore saves all keys, hit counters and server settings to disk so
+// keyserver can pick up where it left off after a restart. Operators' changes
+// are saved straight away, hits only mark the state dirty and are saved by
+// FlushEvery so requests never wait on the disk.
+type StateStore struct {
+	Path  string
+	Http  *HttpServer
+	Dns   *DnsServer
+	mu    sync.Mutex
+	dirty int32 // set when there are hits that haven't been saved, accessed atomically
+}
+
+// Snapshot is the serializable form of both servers. Constraint validators
+// can't be serialized, so keys only store constraint values and are rebuilt
+// through GetHttpKeyConstraints/GetDnsKeyConstraints when loaded.
+type Snapshot struct {
+	HttpSettings map[string]string
+	DnsSettings  map[string]string
+	HttpKeys     map[string]*KeyState
+	DnsKeys      map[string]*KeyState
+}
+
+// KeyState is the serializable form of a Key, also used for engagement
+// files which leave out the hit history
+type KeyState struct {
+	Type        string
+	On          bool
+	Disabled    bool
+	SendAlerts  bool
+	HitCounter  map[string]int `json:",omitempty" yaml:",omitempty"`
+	LastHit     string         `json:",omitempty" yaml:",omitempty"`
+	Data        map[string]string
+	Constraints map[string]string
+	Expression  string
+	Hashes      map[string]string
+	Material    string `json:",omitempty" yaml:",omitempty"`
+	Content     []byte `json:",omitempty" yaml:",omitempty"` // pinned HTTP file contents
+}
+
+// NewStateStore returns a StateStore that saves the given servers to path
+func NewStateStore(path string, h *HttpServer, d *DnsServer) *StateStore {
+	return &StateStore{
+		Path: path,
+		Http: h,
+		Dns:  d,
+	}
+}
+
+// Save writes the current state of both servers to disk. The file is written
+// to a temp file first and renamed over the old one so a crash mid-write
+// can't leave a truncated state file behind.
+func (s *StateStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(TakeSnapshot(s.Http, s.Dns), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), ".keyserver-state-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// Persist saves the state and logs any error, suitable for the servers' OnChange
+func (s *StateStore) Persist() {
+	// anything from here on is caught by the next flush
+	atomic.StoreInt32(&s.dirty, 0)
+	if err := s.Save(); err != nil {
+		logger.Log.Warningf("[ERROR] - Error saving state to %s: %s", s.Path, err)
+	}
+}
+
+// MarkDirty notes there are changes to save on the next flush, suitable for
+// the servers' OnHit
+func (s *StateStore) MarkDirty() {
+	atomic.StoreInt32(&s.dirty, 1)
+}
+
+// Flush saves the state if it's been marked dirty since it was last saved
+func (s *StateStore) Flush() {
+	if atomic.LoadInt32(&s.dirty) == 1 {
+		s.Persist()
+	}
+}
+
+// FlushEvery flushes the state every interval, it doesn't return
+func (s *StateStore) FlushEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.Flush()
+	}
+}
+
+// Load reads the state file and restores its settings and keys into the
+// servers. A missing state file is not an error, there's just nothing to restore.
+func (s *StateStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return err
+	}
+	return snap.Restore(s.Http, s.Dns)
+}
+
+// TakeSnapshot captures the settings and keys of both servers. Settings are
+// copied under the servers' locks and keys under their own, so it's safe to
+// call while requests are being served and operators are making changes.
+func TakeSnapshot(h *HttpServer, d *DnsServer) *Snapshot {
+	snap := &Snapshot{
+		HttpSettings: h.SettingValues(),
+		DnsSettings:  d.SettingValues(),
+		HttpKeys:     make(map[string]*KeyState),
+		DnsKeys:      make(map[string]*KeyState),
+	}
+	for name, k := range h.Keys() {
+		snap.HttpKeys[name] = k.ToState()
+	}
+	for name, k := range d.Keys() {
+		snap.DnsKeys[name] = k.ToState()
+	}
+	return snap
+}
+
+// Restore applies the snapshot's settings and keys to the servers, replacing
+// any keys with the same name. Keys that fail to rebuild are skipped and
+// reported in the returned error.
+func (snap *Snapshot) Restore(h *HttpServer, d *DnsServer) error {
+	h.applySettings(snap.HttpSettings)
+	d.applySettings(snap.DnsSettings)
+
+	var failed []string
+	for name, ks := range snap.HttpKeys {
+		k, err := ks.ToKey()
+		if err != nil {
+			failed = append(failed, name+": "+err.Error())
+			continue
+		}
+		h.putKey(name, k)
+	}
+	for name, ks := range snap.DnsKeys {
+		k, err := ks.ToKey()
+		if err != nil {
+			failed = append(failed, name+": "+err.Error())
+			continue
+		}
+		d.putKey(name, k)
+	}
+
+	if len(failed) > 0 {
+		return errors.New("Unable to restore keys, " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// ToState returns the serializable form of the key
+func (k *Key) ToState() *KeyState {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	ks := &KeyState{
+		Type:        k.Type,
+		On:          k.on,
+		Disabled:    k.disabled,
+		SendAlerts:  k.sendAlerts,
+		HitCounter:  make(map[string]int),
+		LastHit:     k.lastHit,
+		Data:        make(map[string]string),
+		Constraints: make(map[string]string),
+		Expression:  k.Expression,
+		Hashes:      make(map[string]string),
+		Material:    k.Material,
+	}
+	if k.Type == "http" && k.Data["DriftPolicy"].Value == "pin" {
+		ks.Content = k.content
+	}
+	for day, hits := range k.hitCounter {
+		ks.HitCounter[day] = hits
+	}
+	for name, kd := range k.Data {
+		ks.Data[name] = kd.Value
+	}
+	for name, kc := range k.Constraints {
+		if kc.Constraint != "" {
+			ks.Constraints[name] = kc.Constraint
+		}
+	}
+	for alg, hash := range k.Hashes {
+		ks.Hashes[alg] = hash
+	}
+	return ks
+}
+
+// ToKey rebuilds a Key from its serialized form. Constraints are recreated
+// from GetHttpKeyConstraints/GetDnsKeyConstraints so their validators are
+// bound to the new Key.
+func (ks *KeyState) ToKey() (*Key, error) {
+	k := NewKey(ks.Type)
+	if k == nil {
+		return nil, errors.New("Unknown key type: " + ks.Type)
+	}
+
+	for name, value := range ks.Data {
+		if kd, ok := k.Data[name]; ok {
+			kd.Value = value
+		}
+	}
+	for name, value := range ks.Constraints {
+		kc, ok := k.Constraints[name]
+		if !ok {
+			return nil, errors.New("Unknown key constraint: " + name)
+		}
+		kc.Constraint = value
+	}
+	if err := validateKeyConstraints(k.Constraints); err != nil {
+		return nil, err
+	}
+	if err := k.SetExpression(ks.Expression); err != nil {
+		return nil, err
+	}
+	if err := checkExpression(k); err != nil {
+		return nil, err
+	}
+	pruneConstraints(k.Constraints)
+	if k.Type == "dns" {
+		if err := k.compileHostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	k.on = ks.On
+	k.disabled = ks.Disabled
+	k.sendAlerts = ks.SendAlerts
+	k.lastHit = ks.LastHit
+	for day, hits := range ks.HitCounter {
+		k.hitCounter[day] = hits
+	}
+	for alg, hash := range ks.Hashes {
+		k.Hashes[alg] = hash
+	}
+	k.Material = ks.Material
+	k.content = ks.Content
+	return k, nil
+}
@@ -0,0 +1,47 @@
+package servers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHitsAreFlushedNotSaved(t *testing.T) {
+	h, d, dir := testServers(t)
+	store := NewStateStore(filepath.Join(dir, "keyserver.state"), h, d)
+	h.OnChange = store.Persist
+	h.OnHit = store.MarkDirty
+
+	if err := h.AddKey(testHttpKey(filepath.Join(dir, "file.html"), "/a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	h.Changed()
+	if _, err := os.Stat(store.Path); err != nil {
+		t.Fatalf("State wasn't saved after a change: %s", err)
+	}
+	os.Remove(store.Path)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+	if _, err := os.Stat(store.Path); !os.IsNotExist(err) {
+		t.Fatal("State was saved from the request")
+	}
+
+	store.Flush()
+	restored := NewStateStore(store.Path, GetHttpServer(), GetDnsServer())
+	if err := restored.Load(); err != nil {
+		t.Fatal(err)
+	}
+	k := restored.Http.GetKey("a")
+	if k == nil || k.GetHits() != 1 {
+		t.Fatal("Hit wasn't saved by Flush")
+	}
+
+	// nothing's changed since
+	os.Remove(store.Path)
+	store.Flush()
+	if _, err := os.Stat(store.Path); !os.IsNotExist(err) {
+		t.Fatal("State was saved again without any changes")
+	}
+}
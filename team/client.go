@@ -0,0 +1,72 @@
+package team
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Dial connects to a team server. The server's certificate is checked
+// against the pinned fingerprint if set, otherwise against the CA
+// certificate at caPath, otherwise against the system's roots.
+func Dial(addr, pin, caPath string) (net.Conn, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case pin != "":
+		want := strings.ToLower(strings.Replace(pin, ":", "", -1))
+		// the fingerprint is all that's checked, so the usual checks are skipped
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || fingerprint(rawCerts[0]) != want {
+				return errors.New("Server certificate doesn't match the fingerprint")
+			}
+			return nil
+		}
+	case caPath != "":
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + caPath)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: loginTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, cfg)
+}
+
+// Login logs in to the team server as the operator, the connection is
+// ready for readline.NewRemoteCli once it returns
+func Login(conn net.Conn, operator, password string) error {
+	conn.SetDeadline(time.Now().Add(loginTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := json.Marshal(&login{Operator: operator, Password: password})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(req, '\n')); err != nil {
+		return err
+	}
+
+	line, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	reply := &loginReply{}
+	if err := json.NewDecoder(bytes.NewReader(line)).Decode(reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package team
+
+// Team server so several operators can each drive the menus from their own
+// keyserver-client, rather than sharing one terminal on the keyserver box.
+// Clients connect over TLS and log in as an operator from the operators file.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Operators are the names and bcrypt password hashes of everyone allowed to
+// connect, saved as a JSON object of name to hash
+type Operators struct {
+	Path   string
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+// LoadOperators reads the operators file, a missing file just means nobody
+// has been added yet
+func LoadOperators(path string) (*Operators, error) {
+	o := &Operators{Path: path, hashes: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &o.hashes); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Add sets the operator's password, adding them if they're new, and saves
+// the operators file
+func (o *Operators) Add(name, password string) error {
+	if name == "" {
+		return errors.New("Operator name can't be empty")
+	}
+	if password == "" {
+		return errors.New("Password can't be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.hashes[name] = string(hash)
+	data, err := json.MarshalIndent(o.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(o.Path, data, 0600)
+}
+
+// Check returns whether the password is right for the operator
+func (o *Operators) Check(name, password string) bool {
+	o.mu.RLock()
+	hash, ok := o.hashes[name]
+	o.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Names returns every operator's name, sorted
+func (o *Operators) Names() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var names []string
+	for name := range o.hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
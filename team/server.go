@@ -0,0 +1,171 @@
+package team
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/leoloobeek/keyserver/cmd"
+	"github.com/leoloobeek/keyserver/logger"
+	"github.com/leoloobeek/keyserver/servers"
+)
+
+const (
+	// loginTimeout is how long a client has to finish the TLS handshake and log in
+	loginTimeout = 10 * time.Second
+
+	// failedLoginDelay slows down password guessing
+	failedLoginDelay = time.Second
+
+	// maxLoginSize limits the login line
+	maxLoginSize = 4096
+)
+
+// login is the first line a client sends, as JSON
+type login struct {
+	Operator string
+	Password string
+}
+
+// loginReply is the server's answer, Error is empty once logged in
+type loginReply struct {
+	Error string `json:",omitempty"`
+}
+
+// Server accepts operators from keyserver-client and runs the menus for each
+// of them against the same HTTP and DNS servers
+type Server struct {
+	Http      *servers.HttpServer
+	Dns       *servers.DnsServer
+	Operators *Operators
+	listener  net.Listener
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{} // connected operators
+}
+
+// NewServer returns a team server for the operators
+func NewServer(h *servers.HttpServer, d *servers.DnsServer, operators *Operators) *Server {
+	return &Server{
+		Http:      h,
+		Dns:       d,
+		Operators: operators,
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on addr with the certificate and accepts operators in the
+// background. Listening errors are returned straight away.
+func (s *Server) Start(addr string, cert tls.Certificate) error {
+	if len(s.Operators.Names()) == 0 {
+		return errors.New("No operators to log in as, add one with -add-operator first")
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return nil
+}
+
+// Stop stops accepting operators and disconnects everyone
+func (s *Server) Stop() {
+	if s.listener == nil {
+		return
+	}
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// handle logs the operator in and runs their session until they exit or
+// disconnect
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	source := conn.RemoteAddr().String()
+
+	conn.SetDeadline(time.Now().Add(loginTimeout))
+	operator, err := s.login(conn)
+	if err != nil {
+		logger.Log.Warningf("[TEAM] - Failed login from %s: %s", source, err)
+		time.Sleep(failedLoginDelay)
+		json.NewEncoder(conn).Encode(&loginReply{Error: "Login failed"})
+		return
+	}
+	if err := json.NewEncoder(conn).Encode(&loginReply{}); err != nil {
+		return
+	}
+
+	session, err := cmd.NewRemoteSession(conn, operator, s.Http, s.Dns)
+	if err != nil {
+		logger.Log.Warningf("[TEAM] - Error starting session for %s from %s: %s", operator, source, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	logger.Log.Noticef("[TEAM] - Operator '%s' connected from %s", operator, source)
+
+	stop := session.WatchKeyChanges()
+	session.Run()
+	stop()
+	session.Close()
+
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	logger.Log.Noticef("[TEAM] - Operator '%s' disconnected", operator)
+}
+
+// login reads the client's login line and checks it
+func (s *Server) login(conn net.Conn) (string, error) {
+	line, err := readLine(conn)
+	if err != nil {
+		return "", err
+	}
+	req := &login{}
+	if err := json.Unmarshal(line, req); err != nil {
+		return "", errors.New("Invalid login")
+	}
+	if !s.Operators.Check(req.Operator, req.Password) {
+		return "", errors.New("Wrong operator name or password for '" + req.Operator + "'")
+	}
+	return req.Operator, nil
+}
+
+// readLine reads up to a newline a byte at a time, so nothing after it is
+// taken from conn before the readline session starts
+func readLine(conn net.Conn) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxLoginSize {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, errors.New("Login too long")
+}
@@ -0,0 +1,191 @@
+package team
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leoloobeek/keyserver/servers"
+	logging "github.com/op/go-logging"
+)
+
+func init() {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "keyserver-team-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// testServer starts a team server on loopback with the operator alice
+func testServer(t *testing.T) (*Server, string) {
+	dir := tempDir(t)
+	ops, err := LoadOperators(filepath.Join(dir, "operators.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.Add("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadOrCreateCert(filepath.Join(dir, "team.crt"), filepath.Join(dir, "team.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(servers.GetHttpServer(), servers.GetDnsServer(), ops)
+	if err := s.Start("127.0.0.1:0", cert); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s, Fingerprint(cert)
+}
+
+func TestOperators(t *testing.T) {
+	path := filepath.Join(tempDir(t), "operators.json")
+	ops, err := LoadOperators(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.Add("", "password"); err == nil {
+		t.Error("Operator added without a name")
+	}
+	if err := ops.Add("alice", ""); err == nil {
+		t.Error("Operator added without a password")
+	}
+	if err := ops.Add("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Operators file has mode %o, want 600", info.Mode().Perm())
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "correct horse") || !strings.Contains(string(data), "$2a$") {
+		t.Error("Password isn't saved as a bcrypt hash")
+	}
+
+	loaded, err := LoadOperators(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, password string
+		want           bool
+	}{
+		{"alice", "correct horse", true},
+		{"alice", "Correct horse", false},
+		{"alice", "", false},
+		{"bob", "correct horse", false},
+	} {
+		if got := loaded.Check(tc.name, tc.password); got != tc.want {
+			t.Errorf("Check(%q, %q) = %v, want %v", tc.name, tc.password, got, tc.want)
+		}
+	}
+
+	// changing the password replaces the old one
+	if err := loaded.Add("alice", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Check("alice", "correct horse") || !loaded.Check("alice", "battery staple") {
+		t.Error("Password wasn't changed")
+	}
+}
+
+func TestGeneratedCertMatchesFingerprint(t *testing.T) {
+	dir := tempDir(t)
+	certPath, keyPath := filepath.Join(dir, "team.crt"), filepath.Join(dir, "team.key")
+	cert, err := LoadOrCreateCert(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Private key isn't owner only: %v", err)
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	if Fingerprint(cert) != hex.EncodeToString(sum[:]) {
+		t.Error("Fingerprint isn't the SHA-256 of the certificate")
+	}
+	loaded, err := LoadOrCreateCert(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(loaded) != Fingerprint(cert) {
+		t.Error("Certificate was regenerated rather than loaded")
+	}
+}
+
+func TestDialChecksPin(t *testing.T) {
+	s, pin := testServer(t)
+	addr := s.listener.Addr().String()
+
+	// fingerprints are often copied with colons and in upper case
+	var colons []string
+	for i := 0; i < len(pin); i += 2 {
+		colons = append(colons, strings.ToUpper(pin[i:i+2]))
+	}
+	for _, good := range []string{pin, strings.Join(colons, ":")} {
+		conn, err := Dial(addr, good, "")
+		if err != nil {
+			t.Errorf("Dial with pin %s: %s", good, err)
+			continue
+		}
+		conn.Close()
+	}
+
+	wrong := strings.Repeat("0", len(pin))
+	if conn, err := Dial(addr, wrong, ""); err == nil {
+		conn.Close()
+		t.Error("Dial succeeded with the wrong pin")
+	}
+	// without a pin or CA the self signed certificate isn't trusted
+	if conn, err := Dial(addr, "", ""); err == nil {
+		conn.Close()
+		t.Error("Dial trusted a self signed certificate")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s, pin := testServer(t)
+	addr := s.listener.Addr().String()
+
+	conn, err := Dial(addr, pin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = Login(conn, "alice", "wrong")
+	conn.Close()
+	if err == nil {
+		t.Fatal("Logged in with the wrong password")
+	}
+	if strings.Contains(err.Error(), "alice") {
+		t.Errorf("Login error tells the client too much: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < failedLoginDelay {
+		t.Errorf("Failed login answered after %s, want at least %s", elapsed, failedLoginDelay)
+	}
+
+	conn, err = Dial(addr, pin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Login(conn, "alice", "correct horse"); err != nil {
+		t.Errorf("Login with the right password: %s", err)
+	}
+}